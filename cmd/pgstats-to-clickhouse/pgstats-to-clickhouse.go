@@ -2,111 +2,217 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/chobostar/pgstats-to-clickhouse/db/migrations"
 	"github.com/chobostar/pgstats-to-clickhouse/internal"
-	"log"
+	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
-	"sync"
+	"strings"
 	"syscall"
 	"time"
 )
 
+// version задается при сборке: go build -ldflags "-X main.version=v1.2.3"
+var version = "dev"
+
 var usage = `pgstats-to-clickhouse - collects pg_stat_statements, pg_statio_all_tables and pg_stat_tables output and pushes to remote clickhouse
 
-read settings from ENV:
-	INTERVAL - collect interval in seconds (default: "30s", valid units are "ns", "us" (or "µs"), "ms", "s", "m", "h")
-	POSTGRES_DSN - connection to postgres for pg_stat_statements (default: "postgres://postgres@localhost:5432/postgres?sslmode=disable")
-	CLICKHOUSE_DSN - connection to clickhouse for pg_stat_statements (default: "http://localhost:8123/default")
-	STATIO_POSTGRES_DSN - connection to postgres for pg_statio and pg_stat_tables (disabled by default: "")
+usage:
+	pgstats-to-clickhouse [run] [flags]
+		run the daemon
+	pgstats-to-clickhouse migrate [flags]
+		create clickhouse tables, the DDL is embedded into the binary
+	pgstats-to-clickhouse check [flags]
+		check connectivity, grants and extensions in postgres and tables in clickhouse for every enabled collector
+	pgstats-to-clickhouse collect [--collector=PgStatStatements] [--format=table] [flags]
+		print one snapshot of a collector to stdout as json, csv or table
+	pgstats-to-clickhouse diff [--collector=PgStatStatements] [--format=table] [--wait=10s] [flags]
+		print deltas between two snapshots taken --wait apart, as they would be pushed
+	pgstats-to-clickhouse --version
+
+settings are read from ENV, CONFIG_FILE overrides ENV and flags override both:
 `
 
 func main() {
-	cfg, err := internal.NewConfig()
-	if err != nil {
-		log.Println(usage)
-		log.Fatalf(err.Error())
+	command, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
 	}
 
-	log.Println("- - - - - - - - - - - - - - -")
-	log.Println("daemon started")
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage+internal.ConfigUsage()) }
+	flags := internal.RegisterConfigFlags(fs)
+	showVersion := fs.Bool("version", false, "print version and exit")
+
+	var run func(cfg *internal.Config) error
+	switch command {
+	case "run":
+		run = runCommand(flags)
+	case "migrate":
+		run = migrateCommand
+	case "check":
+		run = checkCommand
+	case "collect":
+		run = collectCommand(fs)
+	case "diff":
+		run = diffCommand(fs)
+	default:
+		exitUsage(fmt.Errorf("unknown command %q", command))
+	}
+	_ = fs.Parse(args)
+	if *showVersion {
+		fmt.Println(version)
+		return
+	}
 
-	var wg sync.WaitGroup
-	if cfg.StatioPostgresDsn != "" {
-		wg.Add(1)
-		go setupPSTCollector(handleSignals(), cfg.Interval, cfg.StatioPostgresDsn, cfg.ClickhouseDsn, &wg)
-		wg.Add(1)
-		//use x4 interval because of slowly changing value
-		go setupPTSCollector(handleSignals(), cfg.Interval*4, cfg.StatioPostgresDsn, cfg.ClickhouseDsn, &wg)
+	cfg, err := flags.NewConfig()
+	if err != nil {
+		exitUsage(err)
 	}
-	wg.Add(1)
-	go setupPSSCollector(handleSignals(), cfg.Interval, cfg.PostgresDsn, cfg.ClickhouseDsn, &wg)
+	logger, err := internal.NewLogger(os.Stderr, cfg.LogLevel, cfg.LogFormat)
+	if err != nil {
+		exitUsage(err)
+	}
+	slog.SetDefault(logger)
 
-	wg.Wait()
+	if err = run(cfg); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+}
 
-	log.Println("daemon terminated")
+func exitUsage(err error) {
+	fmt.Fprint(os.Stderr, usage+internal.ConfigUsage())
+	fmt.Fprintln(os.Stderr, err.Error())
+	os.Exit(2)
 }
 
-func handleSignals() context.Context {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+func runCommand(flags internal.ConfigFlags) func(cfg *internal.Config) error {
+	return func(cfg *internal.Config) error {
+		slog.Info("daemon started", "version", version, "dry_run", cfg.DryRun)
 
-	ctx, cancel := context.WithCancel(context.Background())
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
 
-	go func() {
-		oscall := <-c
-		log.Printf("got system call:%+v", oscall)
-		cancel()
-	}()
+		hostname, _ := os.Hostname()
+		supervisor := internal.NewSupervisor(cfg, hostname)
+		reload := func() error {
+			cfg, err := flags.NewConfig()
+			if err != nil {
+				return fmt.Errorf("config reload failed, keep running with previous config: %w", err)
+			}
+			if err = internal.SetLogLevel(cfg.LogLevel); err != nil {
+				return fmt.Errorf("config reload failed, keep running with previous config: %w", err)
+			}
+			supervisor.Reload(cfg)
+			return nil
+		}
+		go handleReload(ctx, reload)
+
+		if cfg.HTTPListen != "" {
+			server := internal.NewHTTPServer(cfg.HTTPListen, supervisor, reload, cfg.ReadyIntervals)
+			go func() {
+				if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					slog.Error("http server failed", "error", err)
+				}
+			}()
+			defer server.Close()
+		}
 
-	return ctx
-}
+		if err := supervisor.Run(ctx); err != nil {
+			return err
+		}
 
-func setupPSSCollector(ctx context.Context, interval time.Duration, postgresDsn string, clickhouseDsn string, wg *sync.WaitGroup) {
-	defer wg.Done()
-	setupCollector(ctx, &internal.PgStatStatementsFactory{}, interval, postgresDsn, clickhouseDsn)
+		slog.Info("daemon terminated")
+		return nil
+	}
 }
 
-func setupPSTCollector(ctx context.Context, interval time.Duration, postgresDsn string, clickhouseDsn string, wg *sync.WaitGroup) {
-	defer wg.Done()
-	setupCollector(ctx, &internal.PgStatioTableFactory{}, interval, postgresDsn, clickhouseDsn)
-}
+func migrateCommand(cfg *internal.Config) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-func setupPTSCollector(ctx context.Context, interval time.Duration, postgresDsn string, clickhouseDsn string, wg *sync.WaitGroup) {
-	defer wg.Done()
-	setupCollector(ctx, &internal.PgTableSizeFactory{}, interval, postgresDsn, clickhouseDsn)
+	return internal.Migrate(ctx, cfg.ClickhouseDsn, migrations.ClickHouse, internal.ClickhouseTables{
+		Database: cfg.ClickhouseDatabase,
+		Prefix:   cfg.ClickhouseTablePrefix,
+	})
 }
 
-func setupCollector(ctx context.Context, collector internal.CollectorFactory, interval time.Duration, postgresDsn string, clickhouseDsn string) {
-	hostname, _ := os.Hostname()
-	ttl := int64(interval/time.Second) * 2
-	sc, err := internal.NewStatsCollector(
-		collector,
-		hostname,
-		postgresDsn,
-		clickhouseDsn,
-		ttl,
-	)
+func checkCommand(cfg *internal.Config) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, cfg.Interval)
+	defer cancel()
+
+	failed, err := internal.WriteCheckResults(os.Stdout, internal.Check(ctx, cfg))
 	if err != nil {
-		log.Fatalf("[%s] Unable to init collector: %v", collector.Name(), err)
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
 	}
+	return nil
+}
 
-	go func() {
-		collectTick := time.Tick(interval)
-		for {
-			<-collectTick
-			if err := sc.Tick(); err != nil {
-				log.Printf("[%s] Error during tick: %v", collector.Name(), err)
-			}
-		}
-	}()
+func collectCommand(fs *flag.FlagSet) func(cfg *internal.Config) error {
+	collector := fs.String("collector", "PgStatStatements", "PgStatStatements, PgStatioTable or PgTableSize")
+	format := fs.String("format", "table", "json, csv or table")
 
-	log.Printf("[%s] collector started", collector.Name())
+	return func(cfg *internal.Config) error {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
 
-	<-ctx.Done()
+		hostname, _ := os.Hostname()
+		sc, err := internal.NewCLICollector(ctx, cfg, hostname, *collector, int64(cfg.Interval/time.Second)*2)
+		if err != nil {
+			return err
+		}
+		defer sc.Shutdown()
+		return internal.CollectOnce(sc, os.Stdout, *format)
+	}
+}
 
-	if err = sc.Shutdown(); err != nil {
-		log.Fatalf("[%s] collector shutdown failed: %v", collector.Name(), err)
+func diffCommand(fs *flag.FlagSet) func(cfg *internal.Config) error {
+	collector := fs.String("collector", "PgStatStatements", "PgStatStatements, PgStatioTable or PgTableSize")
+	format := fs.String("format", "table", "json, csv or table")
+	wait := fs.Duration("wait", 10*time.Second, "pause between two snapshots")
+
+	return func(cfg *internal.Config) error {
+		if *wait <= 0 {
+			return errors.New("--wait should be positive")
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		hostname, _ := os.Hostname()
+		// ttl с запасом, чтобы второй снапшот не считался истекшим
+		sc, err := internal.NewCLICollector(ctx, cfg, hostname, *collector, int64(*wait/time.Second)*2+1)
+		if err != nil {
+			return err
+		}
+		defer sc.Shutdown()
+		return internal.DiffOnce(ctx, sc, *wait, os.Stdout, *format)
 	}
+}
 
-	log.Printf("[%s] collector stopped", collector.Name())
+func handleReload(ctx context.Context, reload func() error) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	defer signal.Stop(c)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c:
+			slog.Info("got SIGHUP, reloading config")
+			if err := reload(); err != nil {
+				slog.Error("reload failed", "error", err)
+			}
+		}
+	}
 }
@@ -0,0 +1,43 @@
+-- text/template, see 001_init.sql. Label columns for tables created before LABELS were added
+
+ALTER TABLE {{.Database}}.{{.Prefix}}pg_stat_statements
+    ADD COLUMN IF NOT EXISTS cluster LowCardinality(String) AFTER hostname,
+    ADD COLUMN IF NOT EXISTS environment LowCardinality(String) AFTER cluster,
+    ADD COLUMN IF NOT EXISTS role LowCardinality(String) AFTER environment,
+    ADD COLUMN IF NOT EXISTS shard LowCardinality(String) AFTER role,
+    ADD COLUMN IF NOT EXISTS datacenter LowCardinality(String) AFTER shard;
+
+ALTER TABLE {{.Database}}.{{.Prefix}}pg_stat_statements_buffer
+    ADD COLUMN IF NOT EXISTS cluster LowCardinality(String) AFTER hostname,
+    ADD COLUMN IF NOT EXISTS environment LowCardinality(String) AFTER cluster,
+    ADD COLUMN IF NOT EXISTS role LowCardinality(String) AFTER environment,
+    ADD COLUMN IF NOT EXISTS shard LowCardinality(String) AFTER role,
+    ADD COLUMN IF NOT EXISTS datacenter LowCardinality(String) AFTER shard;
+
+ALTER TABLE {{.Database}}.{{.Prefix}}pg_statio_tables
+    ADD COLUMN IF NOT EXISTS cluster LowCardinality(String) AFTER hostname,
+    ADD COLUMN IF NOT EXISTS environment LowCardinality(String) AFTER cluster,
+    ADD COLUMN IF NOT EXISTS role LowCardinality(String) AFTER environment,
+    ADD COLUMN IF NOT EXISTS shard LowCardinality(String) AFTER role,
+    ADD COLUMN IF NOT EXISTS datacenter LowCardinality(String) AFTER shard;
+
+ALTER TABLE {{.Database}}.{{.Prefix}}pg_statio_tables_buffer
+    ADD COLUMN IF NOT EXISTS cluster LowCardinality(String) AFTER hostname,
+    ADD COLUMN IF NOT EXISTS environment LowCardinality(String) AFTER cluster,
+    ADD COLUMN IF NOT EXISTS role LowCardinality(String) AFTER environment,
+    ADD COLUMN IF NOT EXISTS shard LowCardinality(String) AFTER role,
+    ADD COLUMN IF NOT EXISTS datacenter LowCardinality(String) AFTER shard;
+
+ALTER TABLE {{.Database}}.{{.Prefix}}pg_table_size
+    ADD COLUMN IF NOT EXISTS cluster LowCardinality(String) AFTER hostname,
+    ADD COLUMN IF NOT EXISTS environment LowCardinality(String) AFTER cluster,
+    ADD COLUMN IF NOT EXISTS role LowCardinality(String) AFTER environment,
+    ADD COLUMN IF NOT EXISTS shard LowCardinality(String) AFTER role,
+    ADD COLUMN IF NOT EXISTS datacenter LowCardinality(String) AFTER shard;
+
+ALTER TABLE {{.Database}}.{{.Prefix}}pg_table_size_buffer
+    ADD COLUMN IF NOT EXISTS cluster LowCardinality(String) AFTER hostname,
+    ADD COLUMN IF NOT EXISTS environment LowCardinality(String) AFTER cluster,
+    ADD COLUMN IF NOT EXISTS role LowCardinality(String) AFTER environment,
+    ADD COLUMN IF NOT EXISTS shard LowCardinality(String) AFTER role,
+    ADD COLUMN IF NOT EXISTS datacenter LowCardinality(String) AFTER shard;
@@ -0,0 +1,19 @@
+-- text/template, see 001_init.sql. Role of the instance at the moment of the tick: primary or standby
+
+ALTER TABLE {{.Database}}.{{.Prefix}}pg_stat_statements
+    ADD COLUMN IF NOT EXISTS pg_role LowCardinality(String) AFTER hostname;
+
+ALTER TABLE {{.Database}}.{{.Prefix}}pg_stat_statements_buffer
+    ADD COLUMN IF NOT EXISTS pg_role LowCardinality(String) AFTER hostname;
+
+ALTER TABLE {{.Database}}.{{.Prefix}}pg_statio_tables
+    ADD COLUMN IF NOT EXISTS pg_role LowCardinality(String) AFTER hostname;
+
+ALTER TABLE {{.Database}}.{{.Prefix}}pg_statio_tables_buffer
+    ADD COLUMN IF NOT EXISTS pg_role LowCardinality(String) AFTER hostname;
+
+ALTER TABLE {{.Database}}.{{.Prefix}}pg_table_size
+    ADD COLUMN IF NOT EXISTS pg_role LowCardinality(String) AFTER hostname;
+
+ALTER TABLE {{.Database}}.{{.Prefix}}pg_table_size_buffer
+    ADD COLUMN IF NOT EXISTS pg_role LowCardinality(String) AFTER hostname;
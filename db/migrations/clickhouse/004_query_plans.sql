@@ -0,0 +1,28 @@
+-- text/template, see 001_init.sql. Plans of top statements from pg_store_plans, PLAN_SAMPLE_TOP.
+-- A row is written when a statement gets into the top for the first time since start or its plan has changed
+
+CREATE TABLE IF NOT EXISTS {{.Database}}.{{.Prefix}}pg_query_plans (
+     created_date Date DEFAULT today(),
+     created_at UInt32 DEFAULT toUInt32(now()) Codec(Delta, ZSTD),
+     hostname LowCardinality(String),
+     pg_role LowCardinality(String),
+     cluster LowCardinality(String),
+     environment LowCardinality(String),
+     role LowCardinality(String),
+     shard LowCardinality(String),
+     datacenter LowCardinality(String),
+     datname LowCardinality(String),
+     username LowCardinality(String),
+     queryid Int64,
+     plan_hash Int64,
+     previous_plan_hash Int64,
+     plan_changed UInt8,
+     calls Float64,
+     total_time Float64,
+     query String,
+     plan String
+) ENGINE = ReplicatedMergeTree('{{zooKeeperPath "pg_query_plans"}}', '{replica}')
+    PARTITION BY toYYYYMM(created_date)
+    ORDER BY (hostname, queryid, created_at)
+    TTL created_date + toIntervalDay(30)
+    SETTINGS index_granularity = 8192;
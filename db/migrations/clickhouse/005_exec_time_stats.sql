@@ -0,0 +1,14 @@
+-- text/template, see 001_init.sql. Execution time stats of pg_stat_statements: mean_time and stddev_time of the interval,
+-- min_time and max_time since pg_stat_statements_reset()
+
+ALTER TABLE {{.Database}}.{{.Prefix}}pg_stat_statements
+    ADD COLUMN IF NOT EXISTS min_time Float64 AFTER total_time,
+    ADD COLUMN IF NOT EXISTS max_time Float64 AFTER min_time,
+    ADD COLUMN IF NOT EXISTS mean_time Float64 AFTER max_time,
+    ADD COLUMN IF NOT EXISTS stddev_time Float64 AFTER mean_time;
+
+ALTER TABLE {{.Database}}.{{.Prefix}}pg_stat_statements_buffer
+    ADD COLUMN IF NOT EXISTS min_time Float64 AFTER total_time,
+    ADD COLUMN IF NOT EXISTS max_time Float64 AFTER min_time,
+    ADD COLUMN IF NOT EXISTS mean_time Float64 AFTER max_time,
+    ADD COLUMN IF NOT EXISTS stddev_time Float64 AFTER mean_time;
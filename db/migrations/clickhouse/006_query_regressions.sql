@@ -0,0 +1,29 @@
+-- text/template, see 001_init.sql. Regressions of statements found by REGRESSION_FACTOR:
+-- per-call latency and rows of the interval against the rolling baseline of the daemon, reason is what has grown
+
+CREATE TABLE IF NOT EXISTS {{.Database}}.{{.Prefix}}pg_query_regressions (
+     created_date Date DEFAULT today(),
+     created_at UInt32 DEFAULT toUInt32(now()) Codec(Delta, ZSTD),
+     hostname LowCardinality(String),
+     pg_role LowCardinality(String),
+     cluster LowCardinality(String),
+     environment LowCardinality(String),
+     role LowCardinality(String),
+     shard LowCardinality(String),
+     datacenter LowCardinality(String),
+     datname LowCardinality(String),
+     username LowCardinality(String),
+     queryid Int64,
+     query String,
+     reason LowCardinality(String),
+     calls Float64,
+     latency Float64,
+     baseline_latency Float64,
+     ratio Float64,
+     rows_per_call Float64,
+     baseline_rows_per_call Float64
+) ENGINE = ReplicatedMergeTree('{{zooKeeperPath "pg_query_regressions"}}', '{replica}')
+    PARTITION BY toYYYYMM(created_date)
+    ORDER BY (hostname, created_at)
+    TTL created_date + toIntervalDay(90)
+    SETTINGS index_granularity = 8192;
@@ -0,0 +1,38 @@
+-- text/template, see 001_init.sql. Growth of tables in bytes per hour between two snapshots of PgTableSize, DISK_CAPACITY
+-- and a linear forecast of days until the disk is full
+
+ALTER TABLE {{.Database}}.{{.Prefix}}pg_table_size
+    ADD COLUMN IF NOT EXISTS size_growth Float64 AFTER idx_size,
+    ADD COLUMN IF NOT EXISTS idx_size_growth Float64 AFTER size_growth,
+    ADD COLUMN IF NOT EXISTS disk_capacity Float64 AFTER idx_size_growth,
+    ADD COLUMN IF NOT EXISTS collected_at Float64 AFTER disk_capacity;
+
+ALTER TABLE {{.Database}}.{{.Prefix}}pg_table_size_buffer
+    ADD COLUMN IF NOT EXISTS size_growth Float64 AFTER idx_size,
+    ADD COLUMN IF NOT EXISTS idx_size_growth Float64 AFTER size_growth,
+    ADD COLUMN IF NOT EXISTS disk_capacity Float64 AFTER idx_size_growth,
+    ADD COLUMN IF NOT EXISTS collected_at Float64 AFTER disk_capacity;
+
+-- collected_at - now() of the snapshot in postgres, the same for all rows of a tick even when a push is split into batches.
+-- used_bytes - tables and indexes of the last snapshot, growth_per_day - slope of their total over the last 7 days,
+-- days_until_full is NULL without DISK_CAPACITY or when the database doesn't grow
+CREATE VIEW IF NOT EXISTS {{.Database}}.{{.Prefix}}pg_table_size_forecast AS
+SELECT
+    hostname,
+    datname,
+    argMax(used, collected_at) AS used_bytes,
+    argMax(capacity, collected_at) AS disk_capacity,
+    simpleLinearRegression(collected_at, used).1 * 86400 AS growth_per_day,
+    if(disk_capacity > 0 AND growth_per_day > 0, greatest(disk_capacity - used_bytes, 0) / growth_per_day, NULL) AS days_until_full
+FROM (
+    SELECT
+        hostname,
+        datname,
+        collected_at,
+        sum(size + idx_size) AS used,
+        max(disk_capacity) AS capacity
+    FROM {{.Database}}.{{.Prefix}}pg_table_size
+    WHERE created_date >= today() - 7 AND collected_at > 0
+    GROUP BY hostname, datname, collected_at
+)
+GROUP BY hostname, datname;
@@ -0,0 +1,9 @@
+// Package migrations встраивает DDL clickhouse в бинарь для команды migrate
+package migrations
+
+import "embed"
+
+// ClickHouse - файлы применяются в лексикографическом порядке имен
+//
+//go:embed clickhouse/*.sql
+var ClickHouse embed.FS
@@ -0,0 +1,524 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	AlertFormatAlertmanager = "alertmanager"
+	AlertFormatSlack        = "slack"
+
+	defaultAlertCooldown = time.Hour
+	// alertMaxPerTick - сколько сработавших правил отправляется за тик, остальные только считаются в логе.
+	// Правило вроде temp_blks_written > 0 может сработать на тысячи запросов сразу
+	alertMaxPerTick = 100
+)
+
+// AlertRule - правило ALERT_RULES: сравнение выражений над колонками строки коллектора, например
+// "temp_blks_written > 100000" для PgStatStatements. Колонки берутся из дельты за интервал
+// (для gauge это текущее значение), rate(column) - прирост колонки в час между двумя снапшотами.
+// Name - необязательное имя правила, alertname в Alertmanager
+type AlertRule struct {
+	Name      string
+	Collector string
+	Condition string
+	op        string
+	left      *alertExpr
+	right     *alertExpr
+	// gauge - в условии только текущие значения gauge колонок, его можно проверить и без прошлой строки
+	gauge bool
+}
+
+// alertExpr - узел выражения: число, колонка, rate(колонка) или op над left и right
+type alertExpr struct {
+	op     byte
+	value  float64
+	column int
+	rate   bool
+	left   *alertExpr
+	right  *alertExpr
+}
+
+// parseAlertRules - правила через ";" в виде "Collector: condition" или "Name = Collector: condition",
+// колонки проверяются по PushColumns коллектора
+func parseAlertRules(s string) ([]AlertRule, error) {
+	var rules []AlertRule
+	for _, text := range strings.Split(s, ";") {
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		kv := strings.SplitN(text, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("expected Collector: condition, got %q", strings.TrimSpace(text))
+		}
+		name, collector := "", strings.TrimSpace(kv[0])
+		if nv := strings.SplitN(collector, "=", 2); len(nv) == 2 {
+			name, collector = strings.TrimSpace(nv[0]), strings.TrimSpace(nv[1])
+			if name == "" {
+				return nil, fmt.Errorf("empty rule name in %q", strings.TrimSpace(text))
+			}
+		}
+		var cf CollectorFactory
+		for _, f := range collectorFactories {
+			if f.Name() == collector {
+				cf = f
+			}
+		}
+		if cf == nil {
+			return nil, fmt.Errorf("unknown collector %q", collector)
+		}
+		rule, err := parseAlertCondition(cf, strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %q: %w", cf.Name(), strings.TrimSpace(kv[1]), err)
+		}
+		rule.Name = name
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseAlertCondition(cf CollectorFactory, condition string) (AlertRule, error) {
+	tokens, err := alertTokens(condition)
+	if err != nil {
+		return AlertRule{}, err
+	}
+	columns := make(map[string]int)
+	for i, c := range pushColumns(cf, Labels{}) {
+		if c.kind == reflect.Float64 && !c.label {
+			columns[c.name] = i
+		}
+	}
+	gauges := make(map[string]bool)
+	for _, name := range cf.gaugeColumns() {
+		gauges[name] = true
+	}
+	p := &alertParser{tokens: tokens, columns: columns, gauges: gauges}
+	rule := AlertRule{Collector: cf.Name(), Condition: condition}
+	if rule.left, err = p.sum(); err != nil {
+		return AlertRule{}, err
+	}
+	switch op := p.next(); op {
+	case ">", ">=", "<", "<=":
+		rule.op = op
+	default:
+		return AlertRule{}, fmt.Errorf("expected >, >=, < or <=, got %q", op)
+	}
+	if rule.right, err = p.sum(); err != nil {
+		return AlertRule{}, err
+	}
+	if p.pos < len(p.tokens) {
+		return AlertRule{}, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	rule.gauge = !p.usesDelta
+	return rule, nil
+}
+
+// alertName - Name правила, без него коллектор и условие: у каждого правила своя группа в Alertmanager
+func (r AlertRule) alertName() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return r.Collector + ": " + r.Condition
+}
+
+// alertTokens - числа, имена колонок, скобки, арифметика и сравнения
+func alertTokens(s string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case strings.ContainsRune("+-*/()", c):
+			tokens = append(tokens, s[i:i+1])
+			i++
+		case c == '>' || c == '<':
+			if i+1 < len(s) && s[i+1] == '=' {
+				tokens = append(tokens, s[i:i+2])
+				i += 2
+			} else {
+				tokens = append(tokens, s[i:i+1])
+				i++
+			}
+		case unicode.IsDigit(c) || c == '.':
+			j := i + 1
+			for j < len(s) && (unicode.IsDigit(rune(s[j])) || s[j] == '.' || s[j] == 'e' ||
+				(s[j-1] == 'e' && (s[j] == '-' || s[j] == '+'))) {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i + 1
+			for j < len(s) && (unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j])) || s[j] == '_') {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected %q", c)
+		}
+	}
+	return tokens, nil
+}
+
+// alertParser - рекурсивный спуск: sum = product {+|- product}, product = unary {*|/ unary},
+// unary = -unary | number | column | rate(column) | (sum)
+type alertParser struct {
+	tokens  []string
+	pos     int
+	columns map[string]int
+	gauges  map[string]bool
+	// usesDelta - в условии есть rate или колонка-счетчик, для нее нужна прошлая строка
+	usesDelta bool
+}
+
+func (p *alertParser) next() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	p.pos++
+	return p.tokens[p.pos-1]
+}
+
+func (p *alertParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *alertParser) sum() (*alertExpr, error) {
+	left, err := p.product()
+	for err == nil && (p.peek() == "+" || p.peek() == "-") {
+		op := p.next()[0]
+		var right *alertExpr
+		if right, err = p.product(); err == nil {
+			left = &alertExpr{op: op, left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *alertParser) product() (*alertExpr, error) {
+	left, err := p.unary()
+	for err == nil && (p.peek() == "*" || p.peek() == "/") {
+		op := p.next()[0]
+		var right *alertExpr
+		if right, err = p.unary(); err == nil {
+			left = &alertExpr{op: op, left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *alertParser) unary() (*alertExpr, error) {
+	token := p.next()
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("unexpected end of condition")
+	case token == "-":
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &alertExpr{op: '-', left: &alertExpr{}, right: operand}, nil
+	case token == "(":
+		e, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("expected )")
+		}
+		return e, nil
+	case unicode.IsDigit(rune(token[0])) || token[0] == '.':
+		v, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q", token)
+		}
+		return &alertExpr{value: v}, nil
+	case token == "rate" && p.peek() == "(":
+		p.next()
+		e, err := p.column(p.next())
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("expected ) after rate(column")
+		}
+		e.rate = true
+		p.usesDelta = true
+		return e, nil
+	default:
+		return p.column(token)
+	}
+}
+
+func (p *alertParser) column(name string) (*alertExpr, error) {
+	i, ok := p.columns[name]
+	if !ok {
+		names := make([]string, 0, len(p.columns))
+		for n := range p.columns {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown column %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+	if !p.gauges[name] {
+		p.usesDelta = true
+	}
+	return &alertExpr{op: 'c', column: i}, nil
+}
+
+// alertRow - значения getValue строки: дельта за интервал, текущие и прошлые накопленные; hours - интервал между снапшотами
+type alertRow struct {
+	delta, current, old []interface{}
+	hours               float64
+}
+
+// eval - значение выражения; false, если его не посчитать: деление на 0 или rate без интервала
+func (e *alertExpr) eval(row alertRow) (float64, bool) {
+	switch e.op {
+	case 0:
+		return e.value, true
+	case 'c':
+		if !e.rate {
+			return plainValue(row.delta[e.column]).(float64), true
+		}
+		if row.hours <= 0 {
+			return 0, false
+		}
+		return (plainValue(row.current[e.column]).(float64) - plainValue(row.old[e.column]).(float64)) / row.hours, true
+	}
+	left, ok := e.left.eval(row)
+	if !ok {
+		return 0, false
+	}
+	right, ok := e.right.eval(row)
+	if !ok {
+		return 0, false
+	}
+	switch e.op {
+	case '+':
+		return left + right, true
+	case '-':
+		return left - right, true
+	case '*':
+		return left * right, true
+	}
+	if right == 0 {
+		return 0, false
+	}
+	return left / right, true
+}
+
+// fires - выполнено ли условие, и значение левой части для алерта
+func (r AlertRule) fires(row alertRow) (float64, bool) {
+	left, ok := r.left.eval(row)
+	if !ok {
+		return left, false
+	}
+	right, ok := r.right.eval(row)
+	if !ok {
+		return left, false
+	}
+	switch r.op {
+	case ">":
+		return left, left > right
+	case ">=":
+		return left, left >= right
+	case "<":
+		return left, left < right
+	}
+	return left, left <= right
+}
+
+// alert - сработавшее правило на строке коллектора. object - строковые колонки строки без hostname и query,
+// по ним и правилу алерты дедуплицируются
+type alert struct {
+	rule   AlertRule
+	object map[string]string
+	query  string
+	value  float64
+	key    string
+}
+
+// alertEvaluator - правила коллектора над дельтами тика. sent - когда алерт последний раз ушел:
+// пока правило срабатывает, повтор уходит не чаще раза в cooldown
+type alertEvaluator struct {
+	rules    []AlertRule
+	cooldown time.Duration
+	columns  []string
+	sent     map[string]time.Time
+	firing   []alert
+	dropped  int
+}
+
+func newAlertEvaluator(cf CollectorFactory, rules []AlertRule, cooldown time.Duration) *alertEvaluator {
+	if cooldown <= 0 {
+		cooldown = defaultAlertCooldown
+	}
+	return &alertEvaluator{rules: rules, cooldown: cooldown, columns: cf.PushColumns(), sent: make(map[string]time.Time)}
+}
+
+// begin - начало тика, сработавшие в прошлом тике сбрасываются
+func (a *alertEvaluator) begin() {
+	a.firing, a.dropped = a.firing[:0], 0
+}
+
+// observe - дельта строки вместе с текущими и прошлыми значениями; hours - время между снапшотами в часах.
+// Без delta (строки нет в прошлом снапшоте или она пропущена isSkippable) проверяются только gauge правила по current.
+// Алерты, отправленные в последний cooldown, не считаются в alertMaxPerTick, чтобы не вытеснять новые
+func (a *alertEvaluator) observe(delta PgMetric, current PgMetric, old PgMetric, hours float64) {
+	var row alertRow
+	for _, rule := range a.rules {
+		if delta == nil && !rule.gauge {
+			continue
+		}
+		if row.delta == nil {
+			if delta == nil {
+				values := current.getValue("")
+				row = alertRow{delta: values, current: values}
+			} else {
+				row = alertRow{delta: delta.getValue(""), current: current.getValue(""), old: old.getValue(""), hours: hours}
+			}
+		}
+		value, ok := rule.fires(row)
+		if !ok {
+			continue
+		}
+		key := fmt.Sprintf("%s:%s:%08x", rule.Collector, rule.Condition, current.getHash())
+		if at, ok := a.sent[key]; ok && time.Since(at) < a.cooldown {
+			continue
+		}
+		if len(a.firing) >= alertMaxPerTick {
+			a.dropped++
+			continue
+		}
+		fired := alert{rule: rule, object: make(map[string]string), value: value, key: key}
+		for i, name := range a.columns {
+			s, isString := plainValue(row.delta[i]).(string)
+			switch {
+			case !isString || name == "hostname":
+			case name == "query":
+				fired.query = s
+			default:
+				fired.object[name] = s
+			}
+		}
+		a.firing = append(a.firing, fired)
+	}
+}
+
+// due - сработавшие в тике алерты, уже отправленные в последний cooldown отсеяны в observe;
+// заодно забываются старые отправки
+func (a *alertEvaluator) due(now time.Time) []alert {
+	for key, at := range a.sent {
+		if now.Sub(at) >= a.cooldown {
+			delete(a.sent, key)
+		}
+	}
+	return append([]alert(nil), a.firing...)
+}
+
+// delivered - алерты ушли, следующая отправка тех же не раньше чем через cooldown
+func (a *alertEvaluator) delivered(alerts []alert, now time.Time) {
+	for _, fired := range alerts {
+		a.sent[fired.key] = now
+	}
+}
+
+// objectString - "datname=postgres schemaname=public tablename=t" в порядке колонок
+func (f alert) objectString() string {
+	names := make([]string, 0, len(f.object))
+	for name := range f.object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, name+"="+f.object[name])
+	}
+	return strings.Join(parts, " ")
+}
+
+// alertmanagerAlert - элемент POST /api/v2/alerts Alertmanager
+type alertmanagerAlert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      time.Time         `json:"endsAt"`
+}
+
+// slackMessage - тело incoming webhook Slack
+type slackMessage struct {
+	Text string `json:"text"`
+}
+
+// alertPayload - тело ALERT_WEBHOOK для формата. Alertmanager-у алерт пересылается раз в cooldown, пока он срабатывает,
+// поэтому endsAt через два cooldown: перестав срабатывать, он разрешится сам
+func (sc *StatsCollector) alertPayload(format string, alerts []alert, cooldown time.Duration, now time.Time) interface{} {
+	labels := sc.labels.withInstance(sc.instance).toMap()
+	if format == AlertFormatSlack {
+		lines := make([]string, 0, len(alerts))
+		for _, fired := range alerts {
+			line := fmt.Sprintf("*%s* `%s` on %s %s: %g", fired.rule.Collector, fired.rule.Condition, sc.hostname, fired.objectString(), fired.value)
+			if fired.rule.Name != "" {
+				line = fired.rule.Name + ": " + line
+			}
+			lines = append(lines, line)
+		}
+		return slackMessage{Text: strings.Join(lines, "\n")}
+	}
+	payload := make([]alertmanagerAlert, 0, len(alerts))
+	for _, fired := range alerts {
+		amAlert := alertmanagerAlert{
+			Labels: map[string]string{"alertname": fired.rule.alertName(), "collector": fired.rule.Collector, "rule": fired.rule.Condition,
+				"hostname": sc.hostname, "instance": sc.instanceName},
+			Annotations: map[string]string{"summary": fmt.Sprintf("%s on %s", fired.rule.Condition, fired.objectString()), "value": strconv.FormatFloat(fired.value, 'g', -1, 64)},
+			StartsAt:    now,
+			EndsAt:      now.Add(2 * cooldown),
+		}
+		for name, value := range labels {
+			amAlert.Labels[name] = value
+		}
+		for name, value := range fired.object {
+			amAlert.Labels[name] = value
+		}
+		if fired.query != "" {
+			amAlert.Annotations["query"] = fired.query
+		}
+		payload = append(payload, amAlert)
+	}
+	return payload
+}
+
+// pushAlerts - сработавшие правила тика в лог и ALERT_WEBHOOK. Неотправленные уйдут на следующем тике, если еще срабатывают
+func (sc *StatsCollector) pushAlerts(ctx context.Context) error {
+	now := time.Now()
+	alerts := sc.alerts.due(now)
+	if sc.alerts.dropped > 0 {
+		sc.logger.Warn("alerts of the tick are truncated", "limit", alertMaxPerTick, "dropped", sc.alerts.dropped)
+	}
+	if len(alerts) == 0 {
+		return nil
+	}
+	for _, fired := range alerts {
+		sc.logger.Warn("alert rule fired", "name", fired.rule.Name, "rule", fired.rule.Condition, "object", fired.objectString(), "value", fired.value)
+	}
+	if sc.alertWebhook != nil && !sc.dryRun {
+		if err := sc.alertWebhook.send(ctx, sc.alertPayload(sc.alertFormat, alerts, sc.alerts.cooldown, now)); err != nil {
+			return fmt.Errorf("alert webhook failed with: %w", err)
+		}
+	}
+	sc.alerts.delivered(alerts, now)
+	return nil
+}
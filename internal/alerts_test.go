@@ -0,0 +1,174 @@
+package internal
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func tableWithSize(tablename string, size float64, live float64, dead float64) *PgTableSize {
+	return &PgTableSize{datname: "postgres", schemaname: "public", tablename: tablename, size: size, n_live_tup: live, n_dead_tup: dead}
+}
+
+func alertRowOf(delta PgMetric, current PgMetric, old PgMetric, hours float64) alertRow {
+	return alertRow{delta: delta.getValue(""), current: current.getValue(""), old: old.getValue(""), hours: hours}
+}
+
+func TestParseAlertRules(t *testing.T) {
+	rules, err := parseAlertRules("PgStatStatements: temp_blks_written > 1e5; PgTableSize: n_dead_tup / (n_live_tup + n_dead_tup) >= 0.2;")
+	assert.NoError(t, err)
+	if assert.Len(t, rules, 2) {
+		assert.Equal(t, "PgStatStatements", rules[0].Collector)
+		assert.Equal(t, "temp_blks_written > 1e5", rules[0].Condition)
+		assert.Equal(t, "PgTableSize", rules[1].Collector)
+		assert.False(t, rules[0].gauge, "a counter needs the previous row")
+		assert.True(t, rules[1].gauge)
+	}
+
+	rules, err = parseAlertRules("DeadTuples = PgTableSize: n_dead_tup > 1000; PgTableSize: rate(size) > 1e9")
+	assert.NoError(t, err)
+	if assert.Len(t, rules, 2) {
+		assert.Equal(t, "DeadTuples", rules[0].Name)
+		assert.Equal(t, "DeadTuples", rules[0].alertName())
+		assert.Equal(t, "PgTableSize", rules[0].Collector)
+		assert.Equal(t, "PgTableSize: rate(size) > 1e9", rules[1].alertName(), "without a name every rule is its own alert")
+		assert.False(t, rules[1].gauge, "rate needs the previous snapshot")
+	}
+
+	for _, invalid := range []string{
+		"temp_blks_written > 1",
+		"PgUnknown: calls > 1",
+		"PgStatStatements: unknown > 1",
+		"PgStatStatements: query > 1",
+		"PgStatStatements: calls",
+		"PgStatStatements: calls > 1 1",
+		"PgStatStatements: (calls > 1",
+		"PgTableSize: rate(size > 1",
+		"PgTableSize: size = 1",
+		" = PgTableSize: size > 1",
+	} {
+		_, err = parseAlertRules(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestAlertRule_Fires(t *testing.T) {
+	rules, err := parseAlertRules("PgTableSize: n_dead_tup / (n_live_tup + n_dead_tup) > 0.2; PgTableSize: rate(size) > 100; PgTableSize: -size * 2 + 10 < 0")
+	assert.NoError(t, err)
+
+	old, current := tableWithSize("t", 1000, 90, 10), tableWithSize("t", 1300, 70, 30)
+	value, ok := rules[0].fires(alertRowOf(current, current, old, 2))
+	assert.True(t, ok)
+	assert.Equal(t, 0.3, value)
+	value, ok = rules[1].fires(alertRowOf(current, current, old, 2))
+	assert.True(t, ok)
+	assert.Equal(t, float64(150), value, "growth per hour")
+	_, ok = rules[2].fires(alertRowOf(current, current, old, 2))
+	assert.True(t, ok)
+
+	empty := tableWithSize("t", 1000, 0, 0)
+	_, ok = rules[0].fires(alertRowOf(empty, empty, old, 2))
+	assert.False(t, ok, "division by zero")
+	_, ok = rules[1].fires(alertRowOf(current, current, old, 0))
+	assert.False(t, ok, "no interval for rate")
+}
+
+func TestAlertEvaluator_Cooldown(t *testing.T) {
+	rules, _ := parseAlertRules("PgTableSize: n_dead_tup > 10")
+	a := newAlertEvaluator(&PgTableSizeFactory{}, rules, time.Hour)
+	table := tableWithSize("t", 0, 0, 20)
+
+	a.begin()
+	a.observe(table, table, table, 1)
+	due := a.due(time.Now())
+	if assert.Len(t, due, 1) {
+		assert.Equal(t, map[string]string{"datname": "postgres", "schemaname": "public", "tablename": "t"}, due[0].object)
+		assert.Equal(t, "datname=postgres schemaname=public tablename=t", due[0].objectString())
+		assert.Equal(t, float64(20), due[0].value)
+	}
+	a.begin()
+	a.observe(table, table, table, 1)
+	assert.Len(t, a.due(time.Now()), 1, "not delivered alert is sent again")
+
+	a.delivered(due, time.Now())
+	a.begin()
+	a.observe(table, table, table, 1)
+	assert.Empty(t, a.due(time.Now()), "within cooldown")
+
+	a.delivered(due, time.Now().Add(-time.Hour))
+	a.begin()
+	a.observe(table, table, table, 1)
+	assert.Len(t, a.due(time.Now()), 1, "cooldown is over")
+}
+
+func TestAlertEvaluator_MaxPerTick(t *testing.T) {
+	rules, _ := parseAlertRules("PgTableSize: n_dead_tup > 10")
+	a := newAlertEvaluator(&PgTableSizeFactory{}, rules, 0)
+	assert.Equal(t, defaultAlertCooldown, a.cooldown)
+
+	a.begin()
+	for i := 0; i < alertMaxPerTick+5; i++ {
+		table := tableWithSize(string(rune('a'+i%26))+string(rune('a'+i/26)), 0, 0, 20)
+		a.observe(table, table, table, 1)
+	}
+	assert.Len(t, a.due(time.Now()), alertMaxPerTick)
+	assert.Equal(t, 5, a.dropped)
+}
+
+func TestAlertPayload(t *testing.T) {
+	rules, _ := parseAlertRules("TempFiles = PgStatStatements: temp_blks_written > 100")
+	sc := &StatsCollector{hostname: "db1", instanceName: "db1:5432/postgres", labels: Labels{Cluster: "main"}, instance: &PgInstance{}}
+	fired := alert{rule: rules[0], object: map[string]string{"datname": "postgres", "username": "app"}, query: "SELECT 1", value: 200}
+	now := time.Now()
+
+	payload := sc.alertPayload(AlertFormatAlertmanager, []alert{fired}, time.Hour, now)
+	if alerts, ok := payload.([]alertmanagerAlert); assert.True(t, ok) && assert.Len(t, alerts, 1) {
+		assert.Equal(t, map[string]string{"alertname": "TempFiles", "collector": "PgStatStatements", "rule": "temp_blks_written > 100", "hostname": "db1",
+			"instance": "db1:5432/postgres", "pg_role": "primary", "cluster": "main", "datname": "postgres", "username": "app"}, alerts[0].Labels)
+		assert.Equal(t, "SELECT 1", alerts[0].Annotations["query"])
+		assert.Equal(t, "200", alerts[0].Annotations["value"])
+		assert.Equal(t, now.Add(2*time.Hour), alerts[0].EndsAt)
+	}
+
+	payload = sc.alertPayload(AlertFormatSlack, []alert{fired}, time.Hour, now)
+	assert.Equal(t, slackMessage{Text: "TempFiles: *PgStatStatements* `temp_blks_written > 100` on db1 datname=postgres username=app: 200"}, payload)
+}
+
+func TestStreamMerge_Alerts(t *testing.T) {
+	rules, _ := parseAlertRules("PgTableSize: rate(size) > 100")
+	sc := &StatsCollector{cf: &PgTableSizeFactory{}, logger: slog.Default(), pushMaxRows: 10,
+		alerts:   newAlertEvaluator(&PgTableSizeFactory{}, rules, time.Hour),
+		snapshot: snapshotOf(time.Now().Add(-time.Hour).Unix(), tableWithSize("fast", 1000, 0, 0), tableWithSize("slow", 1000, 0, 0))}
+	push := func(ctx context.Context, batch []PgMetric, token string) error {
+		return nil
+	}
+	current := []PgMetric{tableWithSize("fast", 2000, 0, 0), tableWithSize("slow", 1050, 0, 0), tableWithSize("new", 5000, 0, 0)}
+
+	sc.streamMerge(context.Background(), scanOf(current, nil), push)
+	due := sc.alerts.due(time.Now())
+	if assert.Len(t, due, 1, "a table new for the snapshot has no rate") {
+		assert.Equal(t, "fast", due[0].object["tablename"])
+		assert.InDelta(t, 1000, due[0].value, 20)
+	}
+}
+
+func TestStreamMerge_AlertsOnNewRows(t *testing.T) {
+	rules, _ := parseAlertRules("PgTableSize: size > 4000; PgTableSize: rate(size) > 100")
+	sc := &StatsCollector{cf: &PgTableSizeFactory{}, logger: slog.Default(), pushMaxRows: 10,
+		alerts:   newAlertEvaluator(&PgTableSizeFactory{}, rules, time.Hour),
+		snapshot: snapshotOf(time.Now().Add(-time.Hour).Unix(), tableWithSize("old", 1000, 0, 0))}
+	push := func(ctx context.Context, batch []PgMetric, token string) error {
+		return nil
+	}
+	current := []PgMetric{tableWithSize("old", 1050, 0, 0), tableWithSize("new", 5000, 0, 0)}
+
+	sc.streamMerge(context.Background(), scanOf(current, nil), push)
+	due := sc.alerts.due(time.Now())
+	if assert.Len(t, due, 1, "a new table is checked by gauge rules only") {
+		assert.Equal(t, "new", due[0].object["tablename"])
+		assert.Equal(t, "size > 4000", due[0].rule.Condition)
+		assert.Equal(t, float64(5000), due[0].value)
+	}
+}
@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"log/slog"
+	"math"
+	"math/rand"
+	"time"
+)
+
+var (
+	defaultBackoffMin       = time.Second
+	defaultBackoffMax       = time.Minute
+	defaultBackoffJitter    = 0.2
+	defaultBreakerThreshold = 3
+)
+
+// Backoff - экспоненциальная задержка с jitter-ом между попытками
+type Backoff struct {
+	Min    time.Duration
+	Max    time.Duration
+	Jitter float64
+}
+
+// Duration - задержка перед попыткой attempt (начиная с 0): Min * 2^attempt, но не больше Max, +/- Jitter
+func (b Backoff) Duration(attempt int) time.Duration {
+	if b.Min <= 0 {
+		b.Min = defaultBackoffMin
+	}
+	if b.Max < b.Min {
+		b.Max = b.Min
+	}
+	d := float64(b.Min) * math.Pow(2, float64(attempt))
+	if d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	if b.Jitter > 0 {
+		d += d * b.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+// circuitBreaker - после threshold ошибок подряд перестает пускать запросы к endpoint-у на время backoff,
+// чтобы недоступный сервер не засыпал лог ошибками на каждом тике. В лог попадают только открытие и закрытие,
+// повторные ошибки открытого breaker-а - на уровне debug
+type circuitBreaker struct {
+	logger    *slog.Logger
+	threshold int
+	backoff   Backoff
+	failures  int
+	openUntil time.Time
+	now       func() time.Time
+}
+
+func newCircuitBreaker(logger *slog.Logger, threshold int, backoff Backoff) *circuitBreaker {
+	if threshold <= 0 {
+		threshold = defaultBreakerThreshold
+	}
+	return &circuitBreaker{
+		logger:    logger,
+		threshold: threshold,
+		backoff:   backoff,
+		now:       time.Now,
+	}
+}
+
+func (cb *circuitBreaker) allow() bool {
+	return !cb.now().Before(cb.openUntil)
+}
+
+func (cb *circuitBreaker) success() {
+	if cb.failures >= cb.threshold {
+		cb.logger.Info("circuit closed", "failures", cb.failures)
+	}
+	cb.failures = 0
+	cb.openUntil = time.Time{}
+}
+
+func (cb *circuitBreaker) failure(err error) {
+	cb.failures++
+	if cb.failures < cb.threshold {
+		return
+	}
+	wait := cb.backoff.Duration(cb.failures - cb.threshold)
+	cb.openUntil = cb.now().Add(wait)
+	if cb.failures == cb.threshold {
+		cb.logger.Warn("circuit open", "wait", wait.Round(time.Millisecond), "failures", cb.failures, "error", err)
+		return
+	}
+	cb.logger.Debug("circuit is still open", "wait", wait.Round(time.Millisecond), "failures", cb.failures, "error", err)
+}
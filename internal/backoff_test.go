@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestBackoff_Duration(t *testing.T) {
+	given := Backoff{Min: time.Second, Max: 10 * time.Second}
+
+	assert.Equal(t, time.Second, given.Duration(0))
+	assert.Equal(t, 2*time.Second, given.Duration(1))
+	assert.Equal(t, 8*time.Second, given.Duration(3))
+	assert.Equal(t, 10*time.Second, given.Duration(4), "backoff should be limited by Max")
+	assert.Equal(t, 10*time.Second, given.Duration(1000), "backoff should be limited by Max")
+}
+
+func TestBackoff_Duration_Jitter(t *testing.T) {
+	given := Backoff{Min: time.Second, Max: time.Minute, Jitter: 0.5}
+
+	for i := 0; i < 100; i++ {
+		d := given.Duration(2)
+		assert.True(t, d >= 2*time.Second && d <= 6*time.Second, "jitter out of range: %s", d)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	cb := newCircuitBreaker(slog.Default(), 2, Backoff{Min: time.Second, Max: time.Minute})
+	cb.now = func() time.Time { return now }
+
+	assert.True(t, cb.allow(), "new breaker should be closed")
+
+	cb.failure(errors.New("fail"))
+	assert.True(t, cb.allow(), "breaker should be closed before threshold")
+
+	cb.failure(errors.New("fail"))
+	assert.False(t, cb.allow(), "breaker should be open after threshold")
+
+	now = now.Add(time.Second)
+	assert.True(t, cb.allow(), "breaker should be half-open after backoff")
+
+	cb.failure(errors.New("fail"))
+	now = now.Add(time.Second)
+	assert.False(t, cb.allow(), "backoff should grow on next failure")
+
+	now = now.Add(time.Second)
+	cb.success()
+	assert.True(t, cb.allow(), "breaker should be closed after success")
+	assert.Equal(t, 0, cb.failures)
+}
+
+func TestCircuitBreaker_LogsTransitions(t *testing.T) {
+	var buf bytes.Buffer
+	cb := newCircuitBreaker(slog.New(slog.NewTextHandler(&buf, nil)), 2, Backoff{Min: time.Millisecond})
+	for i := 0; i < 5; i++ {
+		cb.failure(errors.New("fail"))
+	}
+	cb.success()
+	cb.success()
+
+	assert.Equal(t, 1, bytes.Count(buf.Bytes(), []byte("circuit open")), "open is logged once per outage")
+	assert.Equal(t, 1, bytes.Count(buf.Bytes(), []byte("circuit closed")))
+}
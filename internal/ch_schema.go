@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"strings"
+)
+
+// pushColumn - колонка INSERT-а и Go тип значения, которое для нее отдает getValue
+type pushColumn struct {
+	name  string
+	kind  reflect.Kind
+	label bool
+}
+
+// pushColumns - колонки коллектора и меток с типами, взятыми из getValue пустой метрики. Указатели разыменовываются:
+// getValue отдает их ради избежания копирования, NULL туда не попадает
+func pushColumns(cf CollectorFactory, labels Labels) []pushColumn {
+	names := rowColumns(cf, labels)
+	values := rowValues(cf.emptyMetric(), "", labels)
+	metricColumns := len(cf.PushColumns())
+	columns := make([]pushColumn, 0, len(names))
+	for i, name := range names {
+		t := reflect.TypeOf(values[i])
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		columns = append(columns, pushColumn{name: name, kind: t.Kind(), label: i >= metricColumns})
+	}
+	return columns
+}
+
+// chType - тип колонки clickhouse, в который пишется значение такого вида; используется для добавления колонок
+func (c pushColumn) chType() string {
+	switch c.kind {
+	case reflect.String:
+		return "String"
+	case reflect.Float32, reflect.Float64:
+		return "Float64"
+	case reflect.Uint8, reflect.Bool:
+		return "UInt8"
+	case reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "UInt64"
+	default:
+		return "Int64"
+	}
+}
+
+// addType - тип добавляемой колонки: Nullable, чтобы в старых строках был NULL, а не 0.
+// Метки - LowCardinality(String), в старых строках пустая строка, по ней удобно фильтровать
+func (c pushColumn) addType() string {
+	if c.label {
+		return "LowCardinality(String)"
+	}
+	return "Nullable(" + c.chType() + ")"
+}
+
+// compatible - значение вставится в колонку без ошибки и без потери данных. Nullable и LowCardinality не мешают
+func (c pushColumn) compatible(chType string) bool {
+	chType = unwrapType(chType)
+	switch c.kind {
+	case reflect.String:
+		return chType == "String"
+	case reflect.Float32, reflect.Float64:
+		return chType == "Float64" || chType == "Float32"
+	case reflect.Uint8, reflect.Bool:
+		return chType == "UInt8" || chType == "Bool"
+	default:
+		return strings.HasPrefix(chType, "Int") || strings.HasPrefix(chType, "UInt") || strings.HasPrefix(chType, "Float")
+	}
+}
+
+// unwrapType снимает обертки Nullable(...) и LowCardinality(...)
+func unwrapType(chType string) string {
+	for {
+		unwrapped := false
+		for _, wrapper := range []string{"Nullable(", "LowCardinality("} {
+			if strings.HasPrefix(chType, wrapper) && strings.HasSuffix(chType, ")") {
+				chType = chType[len(wrapper) : len(chType)-1]
+				unwrapped = true
+			}
+		}
+		if !unwrapped {
+			return chType
+		}
+	}
+}
+
+// compareColumns - колонки, которых нет в таблице, и колонки с несовместимым типом в виде "name: Float64 expected, got String"
+func compareColumns(expected []pushColumn, existing map[string]string) (missing []pushColumn, mismatched []string) {
+	for _, c := range expected {
+		chType, ok := existing[c.name]
+		if !ok {
+			missing = append(missing, c)
+			continue
+		}
+		if !c.compatible(chType) {
+			mismatched = append(mismatched, fmt.Sprintf("%s: %s expected, got %s", c.name, c.chType(), chType))
+		}
+	}
+	return missing, mismatched
+}
+
+// tableColumns - имя колонки в тип по system.columns
+func tableColumns(ctx context.Context, db *sql.DB, table string) (map[string]string, error) {
+	database, name := splitTableName(table)
+	rows, err := db.QueryContext(ctx,
+		`SELECT name, type FROM system.columns WHERE database = if(? = '', currentDatabase(), ?) AND table = ?`,
+		database, database, name,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns := make(map[string]string)
+	for rows.Next() {
+		var column, chType string
+		if err = rows.Scan(&column, &chType); err != nil {
+			return nil, err
+		}
+		columns[column] = chType
+	}
+	return columns, rows.Err()
+}
+
+// addColumns добавляет недостающие колонки типа addType, старые парты при этом не переписываются.
+// Для Buffer таблицы сначала меняется таблица назначения, иначе сброс буфера в нее сломается
+func addColumns(ctx context.Context, db *sql.DB, table string, columns []pushColumn) error {
+	tables := []string{table}
+	destination, err := bufferDestination(ctx, db, table)
+	if err != nil {
+		return err
+	}
+	if destination != "" {
+		tables = []string{destination, table}
+	}
+	for _, t := range tables {
+		adds := make([]string, 0, len(columns))
+		for _, c := range columns {
+			adds = append(adds, fmt.Sprintf("ADD COLUMN IF NOT EXISTS %s %s", c.name, c.addType()))
+		}
+		if _, err = db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s %s", t, strings.Join(adds, ", "))); err != nil {
+			return fmt.Errorf("alter %s failed with: %w", t, err)
+		}
+		slog.Info("clickhouse columns added", "table", t, "columns", len(columns))
+	}
+	return nil
+}
+
+// bufferDestination - таблица, в которую сбрасывает Buffer, или "" если table не Buffer
+func bufferDestination(ctx context.Context, db *sql.DB, table string) (string, error) {
+	database, name := splitTableName(table)
+	var engine, engineFull, currentDatabase string
+	err := db.QueryRowContext(ctx,
+		`SELECT engine, engine_full, currentDatabase() FROM system.tables WHERE database = if(? = '', currentDatabase(), ?) AND name = ?`,
+		database, database, name,
+	).Scan(&engine, &engineFull, &currentDatabase)
+	if err != nil {
+		return "", err
+	}
+	if engine != "Buffer" {
+		return "", nil
+	}
+	if database == "" {
+		database = currentDatabase
+	}
+	return parseBufferDestination(engineFull, database)
+}
+
+// parseBufferDestination разбирает "Buffer(db, table, ...)" из engine_full, пустая db значит база самой Buffer таблицы
+func parseBufferDestination(engineFull string, database string) (string, error) {
+	args := strings.TrimSuffix(strings.TrimPrefix(engineFull, "Buffer("), ")")
+	parts := strings.SplitN(args, ",", 3)
+	if len(parts) < 2 {
+		return "", fmt.Errorf("unexpected buffer engine: %s", engineFull)
+	}
+	unquote := func(s string) string { return strings.Trim(strings.TrimSpace(s), "'`\"") }
+	if db := unquote(parts[0]); db != "" {
+		database = db
+	}
+	return database + "." + unquote(parts[1]), nil
+}
@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"github.com/stretchr/testify/assert"
+	"reflect"
+	"testing"
+)
+
+func TestPushColumns(t *testing.T) {
+	for _, f := range []CollectorFactory{&PgStatStatementsFactory{}, &PgStatioTableFactory{}, &PgTableSizeFactory{}} {
+		columns := pushColumns(f, Labels{})
+		assert.Len(t, columns, len(f.PushColumns())+1, f.Name())
+		assert.Equal(t, pushColumn{name: "hostname", kind: reflect.String}, columns[0], f.Name())
+		assert.Equal(t, pushColumn{name: "pg_role", kind: reflect.String, label: true}, columns[len(columns)-1], f.Name())
+		for _, c := range columns {
+			assert.Contains(t, []reflect.Kind{reflect.String, reflect.Float64}, c.kind, "%s: unexpected kind of %s", f.Name(), c.name)
+		}
+	}
+}
+
+func TestPushColumns_Labels(t *testing.T) {
+	columns := pushColumns(&PgTableSizeFactory{}, Labels{Cluster: "main", Shard: "1"})
+	assert.Len(t, columns, len((&PgTableSizeFactory{}).PushColumns())+3)
+	assert.Equal(t, pushColumn{name: "cluster", kind: reflect.String, label: true}, columns[len(columns)-2])
+	assert.Equal(t, pushColumn{name: "shard", kind: reflect.String, label: true}, columns[len(columns)-1])
+	assert.Equal(t, "LowCardinality(String)", columns[len(columns)-1].addType())
+	assert.Equal(t, "Nullable(Float64)", columns[len(columns)-4].addType())
+}
+
+func TestPushColumn_Compatible(t *testing.T) {
+	str := pushColumn{name: "datname", kind: reflect.String}
+	assert.True(t, str.compatible("String"))
+	assert.True(t, str.compatible("LowCardinality(String)"))
+	assert.True(t, str.compatible("LowCardinality(Nullable(String))"))
+	assert.False(t, str.compatible("Float64"))
+
+	float := pushColumn{name: "calls", kind: reflect.Float64}
+	assert.True(t, float.compatible("Float64"))
+	assert.True(t, float.compatible("Nullable(Float64)"))
+	assert.False(t, float.compatible("UInt64"), "float is formatted with exponent and can't be parsed as integer")
+	assert.False(t, float.compatible("String"))
+
+	integer := pushColumn{name: "start_time", kind: reflect.Int64}
+	assert.True(t, integer.compatible("UInt32"))
+	assert.True(t, integer.compatible("Float64"))
+	assert.Equal(t, "Int64", integer.chType())
+}
+
+func TestCompareColumns(t *testing.T) {
+	expected := []pushColumn{
+		{name: "hostname", kind: reflect.String},
+		{name: "calls", kind: reflect.Float64},
+		{name: "rows", kind: reflect.Float64},
+	}
+	missing, mismatched := compareColumns(expected, map[string]string{
+		"created_date": "Date",
+		"hostname":     "LowCardinality(String)",
+		"calls":        "String",
+	})
+	assert.Equal(t, []pushColumn{{name: "rows", kind: reflect.Float64}}, missing)
+	assert.Equal(t, []string{"calls: Float64 expected, got String"}, mismatched)
+}
+
+func TestParseBufferDestination(t *testing.T) {
+	destination, err := parseBufferDestination("Buffer(pg, pg_stat_statements, 16, 10, 30, 1000, 10000, 1000000, 10000000)", "default")
+	assert.NoError(t, err)
+	assert.Equal(t, "pg.pg_stat_statements", destination)
+
+	destination, err = parseBufferDestination("Buffer('', 'pg_table_size', 16, 10, 30, 1000, 10000, 1000000, 10000000)", "stats")
+	assert.NoError(t, err)
+	assert.Equal(t, "stats.pg_table_size", destination)
+
+	_, err = parseBufferDestination("Buffer()", "default")
+	assert.Error(t, err)
+}
@@ -0,0 +1,65 @@
+package internal
+
+const defaultClickhouseDatabase = "pg"
+
+// ClickhouseTables - куда коллектор пишет в clickhouse: база, префикс имен таблиц
+// и Direct - INSERT сразу в MergeTree таблицу вместо Buffer перед ней.
+// Deduplicate - пачки идут с insert_deduplication_token, см. insertDeduplication
+type ClickhouseTables struct {
+	Database    string
+	Prefix      string
+	Direct      bool
+	Deduplicate bool
+}
+
+// table - полное имя таблицы с базой и префиксом
+func (t ClickhouseTables) table(name string) string {
+	return t.Database + "." + t.Prefix + name
+}
+
+// pushTable - таблица, в которую идет INSERT метрик коллектора
+func (t ClickhouseTables) pushTable(cf CollectorFactory) string {
+	if t.Direct {
+		return t.table(cf.TableName())
+	}
+	return t.table(cf.TableName() + "_buffer")
+}
+
+// insertDeduplication - нужен ли пачкам insert_deduplication_token. Buffer таблица сбрасывает строки
+// в MergeTree своими INSERT-ами без токена, поэтому дедупликация работает только при Direct
+func (t ClickhouseTables) insertDeduplication() bool {
+	return t.Direct && t.Deduplicate
+}
+
+// pushRetries - повторы упавших пачек. Без insert_deduplication_token повтор пачки, которую clickhouse принял,
+// но ответ не дошел, посчитает дельты дважды, поэтому такие пачки не повторяются
+func (t ClickhouseTables) pushRetries(retries int) int {
+	if !t.insertDeduplication() {
+		return 0
+	}
+	return retries
+}
+
+func (t ClickhouseTables) instanceEventsTable() string {
+	return t.table("pg_instance_events")
+}
+
+// plansTable - планы запросов PLAN_SAMPLE_TOP, строк мало, поэтому без Buffer
+func (t ClickhouseTables) plansTable() string {
+	return t.table("pg_query_plans")
+}
+
+// regressionsTable - события REGRESSION_FACTOR, тоже без Buffer
+func (t ClickhouseTables) regressionsTable() string {
+	return t.table("pg_query_regressions")
+}
+
+// zooKeeperPath - путь ReplicatedMergeTree. Для базы по умолчанию он тот же, что был до настраиваемых баз,
+// чтобы новые реплики подхватывали существующие таблицы; для остальных баз в путь добавляется имя базы
+func (t ClickhouseTables) zooKeeperPath(name string) string {
+	path := "/clickhouse/{cluster}/tables/{shard}/"
+	if t.Database != defaultClickhouseDatabase {
+		path += t.Database + "/"
+	}
+	return path + t.Prefix + name
+}
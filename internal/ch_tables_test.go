@@ -0,0 +1,45 @@
+package internal
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestClickhouseTables(t *testing.T) {
+	tables := ClickhouseTables{Database: "pg"}
+	assert.Equal(t, "pg.pg_stat_statements_buffer", tables.pushTable(&PgStatStatementsFactory{}))
+	assert.Equal(t, "pg.pg_instance_events", tables.instanceEventsTable())
+	assert.Equal(t, "/clickhouse/{cluster}/tables/{shard}/pg_table_size", tables.zooKeeperPath("pg_table_size"))
+
+	tables = ClickhouseTables{Database: "stats", Prefix: "staging_", Direct: true}
+	assert.Equal(t, "stats.staging_pg_statio_tables", tables.pushTable(&PgStatioTableFactory{}))
+	assert.Equal(t, "stats.staging_pg_instance_events", tables.instanceEventsTable())
+	assert.Equal(t, "stats.staging_pg_query_plans", tables.plansTable())
+	assert.Equal(t, "stats.staging_pg_query_regressions", tables.regressionsTable())
+	assert.Equal(t, "/clickhouse/{cluster}/tables/{shard}/stats/staging_pg_table_size", tables.zooKeeperPath("pg_table_size"))
+}
+
+func TestClickhouseTables_InsertDeduplication(t *testing.T) {
+	assert.True(t, ClickhouseTables{Direct: true, Deduplicate: true}.insertDeduplication())
+	assert.False(t, ClickhouseTables{Deduplicate: true}.insertDeduplication(), "Buffer flushes without the token")
+	assert.False(t, ClickhouseTables{Direct: true}.insertDeduplication())
+}
+
+func TestClickhouseTables_PushRetries(t *testing.T) {
+	assert.Equal(t, 2, ClickhouseTables{Direct: true, Deduplicate: true}.pushRetries(2))
+	assert.Equal(t, 0, ClickhouseTables{Deduplicate: true}.pushRetries(2), "a retry through Buffer may insert the batch twice")
+	assert.Equal(t, 0, ClickhouseTables{Direct: true}.pushRetries(2))
+}
+
+func TestCollectorSpecs_Tables(t *testing.T) {
+	cfg := getDownConfig()
+	cfg.ClickhouseDatabase = "stats"
+	cfg.ClickhouseDirectInsert = []string{"PgTableSize"}
+	cfg.ClickhouseInsertDeduplication = true
+
+	for _, spec := range CollectorSpecs(cfg) {
+		assert.Equal(t, "stats", spec.Tables.Database, spec.Factory.Name())
+		assert.Equal(t, spec.Factory.Name() == "PgTableSize", spec.Tables.Direct, spec.Factory.Name())
+		assert.True(t, spec.Tables.Deduplicate, spec.Factory.Name())
+	}
+}
@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// NewCLICollector - коллектор для разовых команд: без clickhouse, ошибка если postgres недоступен
+func NewCLICollector(ctx context.Context, cfg *Config, hostname string, name string, ttl int64) (*StatsCollector, error) {
+	for _, spec := range CollectorSpecs(cfg) {
+		if spec.Factory.Name() != name {
+			continue
+		}
+		opts := collectorOptions(cfg, spec)
+		opts.DryRun = true
+		opts.SnapshotPath = ""
+		sc, err := NewStatsCollector(ctx, spec.Factory, hostname, spec.PostgresDsn, cfg.ClickhouseDsn, ttl, opts)
+		if err != nil {
+			return nil, err
+		}
+		if !sc.Ready() {
+			if err = sc.Init(ctx); err != nil {
+				_ = sc.Shutdown()
+				return nil, err
+			}
+		}
+		return sc, nil
+	}
+	return nil, fmt.Errorf("unknown or disabled collector %q", name)
+}
+
+// CollectOnce печатает текущий снапшот метрик коллектора
+func CollectOnce(sc *StatsCollector, w io.Writer, format string) error {
+	return WriteMetrics(w, format, sc.cf, sc.hostname, sc.labels.withInstance(sc.instance), sc.snapshot.metrics(sc.cf))
+}
+
+// DiffOnce снимает второй снапшот через wait после начального и печатает дельты, посчитанные Merge
+func DiffOnce(ctx context.Context, sc *StatsCollector, wait time.Duration, w io.Writer, format string) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wait):
+	}
+	newSnap, err := sc.Collect(ctx)
+	if err != nil {
+		return fmt.Errorf("collect failed with: %w", err)
+	}
+	deltaMetrics, err := sc.Merge(ctx, newSnap)
+	if err != nil {
+		return fmt.Errorf("merge failed with: %w", err)
+	}
+	return WriteMetrics(w, format, sc.cf, sc.hostname, sc.labels.withInstance(sc.instance), deltaMetrics)
+}
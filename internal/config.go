@@ -1,8 +1,11 @@
 package internal
 
 import (
+	"flag"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -11,31 +14,458 @@ type Config struct {
 	PostgresDsn       string
 	ClickhouseDsn     string
 	StatioPostgresDsn string
+	SnapshotDir       string
+	BackoffMin        time.Duration
+	BackoffMax        time.Duration
+	BreakerThreshold  int
+	CollectTimeout    time.Duration
+	StatementTimeout  time.Duration
+	LockTimeout       time.Duration
+	ShutdownTimeout   time.Duration
+	ShutdownFlush     bool
+	HTTPListen        string
+	ReadyIntervals    int
+	LogLevel          string
+	LogFormat         string
+	DryRun            bool
+	Preflight         string
+	// ClickhouseAddColumns - добавлять недостающие колонки в таблицы clickhouse на preflight
+	ClickhouseAddColumns  bool
+	ClickhouseDatabase    string
+	ClickhouseTablePrefix string
+	// ClickhouseDirectInsert - коллекторы, которые пишут сразу в MergeTree, минуя Buffer
+	ClickhouseDirectInsert []string
+	// ClickhouseInsertDeduplication - insert_deduplication_token для коллекторов из ClickhouseDirectInsert
+	ClickhouseInsertDeduplication bool
+	Labels                        Labels
+	// PushMaxRows, PushMaxBytes - ограничения одного INSERT-а, тик делится на пачки; PushMaxBytes 0 - без ограничения
+	PushMaxRows  int
+	PushMaxBytes int
+	// PushRetries - сколько раз повторить INSERT упавшей пачки
+	PushRetries int
+	// PlanSampleTop - сколько запросов с наибольшей дельтой total_time за тик сэмплировать из pg_store_plans, 0 - выключено
+	PlanSampleTop int
+	// RegressionFactor - во сколько раз должно вырасти время на вызов запроса относительно baseline, 0 - детектор выключен
+	RegressionFactor   float64
+	RegressionMinCalls int
+	RegressionWebhook  string
+	// AlertRules - правила ALERT_RULES всех коллекторов, AlertCooldown - как часто повторять сработавшее правило
+	AlertRules         []AlertRule
+	AlertCooldown      time.Duration
+	AlertWebhook       string
+	AlertWebhookFormat string
+	// DiskCapacity - байт на диске под таблицы PgTableSize для прогноза заполнения, 0 - не задано
+	DiskCapacity int
 }
 
+// configParam - настройка, которую можно задать через ENV, CONFIG_FILE или флаг командной строки
+type configParam struct {
+	env    string
+	usage  string
+	isBool bool
+}
+
+var configParams = []configParam{
+	{env: "CONFIG_FILE", usage: `env-file with KEY=VALUE lines overriding ENV, re-read on SIGHUP (default: "")`},
+	{env: "INTERVAL", usage: `collect interval in seconds (default: "30s", valid units are "ns", "us" (or "µs"), "ms", "s", "m", "h")`},
+	{env: "POSTGRES_DSN", usage: `connection to postgres for pg_stat_statements (default: "postgres://postgres@localhost:5432/postgres?sslmode=disable")`},
+	{env: "CLICKHOUSE_DSN", usage: `connection to clickhouse for pg_stat_statements (default: "http://localhost:8123/default")`},
+	{env: "STATIO_POSTGRES_DSN", usage: `connection to postgres for pg_statio and pg_stat_tables (disabled by default: "")`},
+	{env: "SNAPSHOT_DIR", usage: `directory to checkpoint metrics snapshots between restarts (disabled by default: "")`},
+	{env: "BACKOFF_MIN", usage: `first delay between reconnect attempts (default: "1s")`},
+	{env: "BACKOFF_MAX", usage: `max delay between reconnect attempts (default: "1m")`},
+	{env: "BREAKER_THRESHOLD", usage: `consecutive failures before postgres or clickhouse is skipped for a backoff delay (default: 3)`},
+	{env: "COLLECT_TIMEOUT", usage: `deadline for one collect-and-push tick (default: collector's interval)`},
+	{env: "STATEMENT_TIMEOUT", usage: `statement_timeout of the monitoring session in postgres (default: not set)`},
+	{env: "LOCK_TIMEOUT", usage: `lock_timeout of the monitoring session in postgres (default: not set)`},
+	{env: "SHUTDOWN_TIMEOUT", usage: `how long to wait for the current and the final tick on shutdown (default: "10s")`},
+	{env: "SHUTDOWN_FLUSH", usage: `collect and push the partial last interval on shutdown (default: true)`, isBool: true},
+	{env: "HTTP_LISTEN", usage: `address of the service http server with /healthz, /readyz and /-/reload, e.g. ":8080" (disabled by default: "")`},
+	{env: "READY_INTERVALS", usage: `/readyz fails if a collector had no successful tick within this amount of its intervals (default: 3)`},
+	{env: "LOG_LEVEL", usage: `debug, info, warn or error; debug also logs every phase of a tick and generated SQL (default: "info")`},
+	{env: "LOG_FORMAT", usage: `text or json (default: "text")`},
+	{env: "DRY_RUN", usage: `log rows instead of pushing them to clickhouse (default: false)`, isBool: true},
+	{env: "CLICKHOUSE_ADD_COLUMNS", usage: `on preflight add columns missing in clickhouse tables as Nullable (default: false)`, isBool: true},
+	{env: "CLICKHOUSE_DATABASE", usage: `clickhouse database with the tables (default: "pg")`},
+	{env: "CLICKHOUSE_TABLE_PREFIX", usage: `prefix of clickhouse table names, e.g. "staging_" (default: "")`},
+	{env: "CLICKHOUSE_DIRECT_INSERT", usage: `comma separated collectors which insert into MergeTree tables directly instead of Buffer ones, e.g. "PgTableSize" (default: "")`},
+	{env: "CLICKHOUSE_INSERT_DEDUPLICATION", usage: `send insert_deduplication_token with every batch of CLICKHOUSE_DIRECT_INSERT collectors, so retried batches are not inserted twice, requires clickhouse 22.2+ (default: true)`, isBool: true},
+	{env: "LABELS", usage: `static labels written to every row, e.g. "cluster=main,environment=prod"; known labels: cluster, environment, role, shard, datacenter (default: "")`},
+	{env: "DISCOVER_CLUSTER_NAME", usage: `fill the cluster label from the cluster_name setting of postgres if LABELS has no cluster (default: false)`, isBool: true},
+	{env: "PUSH_MAX_ROWS", usage: `max rows in one INSERT, a tick is split into batches (default: 10000)`},
+	{env: "PUSH_MAX_BYTES", usage: `max approximate size of values in one INSERT, 0 is unlimited (default: 16777216)`},
+	{env: "PUSH_RETRIES", usage: `how many times a failed INSERT of a batch is retried with backoff within the tick (default: 2)`},
+	{env: "PLAN_SAMPLE_TOP", usage: `capture plans of N statements with the largest total_time of the interval from pg_store_plans (default: 0, disabled)`},
+	{env: "REGRESSION_FACTOR", usage: `write a regression event when the per-call latency of a statement in the interval is N times its baseline, e.g. 3 (default: 0, disabled)`},
+	{env: "REGRESSION_MIN_CALLS", usage: `intervals with fewer calls of a statement are not compared with the baseline (default: 10)`},
+	{env: "REGRESSION_WEBHOOK", usage: `URL to POST regression events of a tick to as JSON (default: "", disabled)`},
+	{env: "ALERT_RULES", usage: `semicolon separated "Collector: condition" or "Name = Collector: condition" rules evaluated on deltas of every tick, e.g. "PgStatStatements: temp_blks_written > 100000; PgTableSize: rate(size) > 1e9" (default: "")`},
+	{env: "ALERT_COOLDOWN", usage: `a fired rule is sent again for the same statement or table not earlier than this (default: "1h")`},
+	{env: "ALERT_WEBHOOK", usage: `URL to POST fired rules to, without it they are only logged (default: "")`},
+	{env: "ALERT_WEBHOOK_FORMAT", usage: `alertmanager (POST /api/v2/alerts) or slack (incoming webhook) (default: "alertmanager")`},
+	{env: "DISK_CAPACITY", usage: `bytes of the disk or tablespace with the tables of STATIO_POSTGRES_DSN, written with table sizes to forecast days until full (default: 0, unknown)`},
+	{env: "PREFLIGHT", usage: `on start check grants, extensions and clickhouse tables of every collector: off, disable (only the collector) or fail (the daemon exits) (default: "disable")`},
+}
+
+// flagName - имя флага для ENV: POSTGRES_DSN -> --postgres-dsn, для CONFIG_FILE короткий --config
+func (p configParam) flagName() string {
+	if p.env == "CONFIG_FILE" {
+		return "config"
+	}
+	return strings.ReplaceAll(strings.ToLower(p.env), "_", "-")
+}
+
+// ConfigFlags - значения флагов командной строки по имени ENV, они перекрывают и CONFIG_FILE, и ENV
+type ConfigFlags map[string]string
+
+// RegisterConfigFlags добавляет в fs флаг на каждую настройку из ENV
+func RegisterConfigFlags(fs *flag.FlagSet) ConfigFlags {
+	values := ConfigFlags{}
+	for _, p := range configParams {
+		env := p.env
+		set := func(v string) error {
+			values[env] = v
+			return nil
+		}
+		if p.isBool {
+			fs.BoolFunc(p.flagName(), p.usage, set)
+		} else {
+			fs.Func(p.flagName(), p.usage, set)
+		}
+	}
+	return values
+}
+
+// NewConfig читает настройки с учетом флагов, вызывается и при reload-е, так что флаги переживают перечитывание CONFIG_FILE
+func (f ConfigFlags) NewConfig() (*Config, error) {
+	return newConfig(f)
+}
+
+// ConfigUsage - список настроек для usage: ENV, флаг и описание
+func ConfigUsage() string {
+	var b strings.Builder
+	for _, p := range configParams {
+		fmt.Fprintf(&b, "\t%s, --%s - %s\n", p.env, p.flagName(), p.usage)
+	}
+	return b.String()
+}
+
+// NewConfig читает настройки из ENV. Если задан CONFIG_FILE, значения из него (KEY=VALUE построчно)
+// перекрывают ENV - этот файл перечитывается при reload-е по SIGHUP
 func NewConfig() (*Config, error) {
+	return newConfig(nil)
+}
+
+func newConfig(flags ConfigFlags) (*Config, error) {
+	path, ok := flags["CONFIG_FILE"]
+	if !ok {
+		path = os.Getenv("CONFIG_FILE")
+	}
+	var file map[string]string
+	if path != "" {
+		var err error
+		if file, err = readConfigFile(path); err != nil {
+			return nil, fmt.Errorf("read config file errors: %w", err)
+		}
+	}
+	getenv := func(name string) string {
+		if v, ok := flags[name]; ok {
+			return v
+		}
+		if v, ok := file[name]; ok {
+			return v
+		}
+		return os.Getenv(name)
+	}
+
 	d, _ := time.ParseDuration("30s")
 	cfg := &Config{
-		Interval:          d,
-		PostgresDsn:       "postgres://postgres@localhost:5432/postgres?sslmode=disable",
-		ClickhouseDsn:     "http://localhost:8123/default",
-		StatioPostgresDsn: "postgres://postgres@localhost:5432/postgres?sslmode=disable",
+		Interval:           d,
+		PostgresDsn:        "postgres://postgres@localhost:5432/postgres?sslmode=disable",
+		ClickhouseDsn:      "http://localhost:8123/default",
+		StatioPostgresDsn:  "postgres://postgres@localhost:5432/postgres?sslmode=disable",
+		BackoffMin:         defaultBackoffMin,
+		BackoffMax:         defaultBackoffMax,
+		BreakerThreshold:   defaultBreakerThreshold,
+		ShutdownTimeout:    defaultShutdownTimeout,
+		ShutdownFlush:      true,
+		ReadyIntervals:     defaultReadyIntervals,
+		LogLevel:           "info",
+		LogFormat:          "text",
+		Preflight:          PreflightDisable,
+		ClickhouseDatabase: defaultClickhouseDatabase,
+		PushMaxRows:        defaultPushMaxRows,
+		PushMaxBytes:       defaultPushMaxBytes,
+		PushRetries:        defaultPushRetries,
+
+		ClickhouseInsertDeduplication: true,
+		RegressionMinCalls:            defaultRegressionMinCalls,
+		AlertCooldown:                 defaultAlertCooldown,
+		AlertWebhookFormat:            AlertFormatAlertmanager,
 	}
-	if v := os.Getenv("INTERVAL"); v != "" {
-		i, err := time.ParseDuration(v)
-		if err != nil {
-			return nil, fmt.Errorf("read params errors: %w", err)
-		}
-		cfg.Interval = i
+	if err := durationEnv(getenv, "INTERVAL", &cfg.Interval); err != nil {
+		return nil, err
 	}
-	if v := os.Getenv("POSTGRES_DSN"); v != "" {
+	if v := getenv("POSTGRES_DSN"); v != "" {
 		cfg.PostgresDsn = v
 	}
-	if v := os.Getenv("CLICKHOUSE_DSN"); v != "" {
+	if v := getenv("CLICKHOUSE_DSN"); v != "" {
 		cfg.ClickhouseDsn = v
 	}
-	if v := os.Getenv("STATIO_POSTGRES_DSN"); v != "" {
+	if v := getenv("STATIO_POSTGRES_DSN"); v != "" {
 		cfg.StatioPostgresDsn = v
 	}
+	if v := getenv("SNAPSHOT_DIR"); v != "" {
+		cfg.SnapshotDir = v
+	}
+	if err := durationEnv(getenv, "BACKOFF_MIN", &cfg.BackoffMin); err != nil {
+		return nil, err
+	}
+	if err := durationEnv(getenv, "BACKOFF_MAX", &cfg.BackoffMax); err != nil {
+		return nil, err
+	}
+	if v := getenv("BREAKER_THRESHOLD"); v != "" {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("read params errors: %w", err)
+		}
+		cfg.BreakerThreshold = i
+	}
+	if err := durationEnv(getenv, "COLLECT_TIMEOUT", &cfg.CollectTimeout); err != nil {
+		return nil, err
+	}
+	if err := durationEnv(getenv, "STATEMENT_TIMEOUT", &cfg.StatementTimeout); err != nil {
+		return nil, err
+	}
+	if err := durationEnv(getenv, "LOCK_TIMEOUT", &cfg.LockTimeout); err != nil {
+		return nil, err
+	}
+	if v := getenv("HTTP_LISTEN"); v != "" {
+		cfg.HTTPListen = v
+	}
+	if v := getenv("READY_INTERVALS"); v != "" {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("read params errors: READY_INTERVALS: %w", err)
+		}
+		cfg.ReadyIntervals = i
+	}
+	if v := getenv("LOG_LEVEL"); v != "" {
+		cfg.LogLevel = v
+	}
+	if v := getenv("LOG_FORMAT"); v != "" {
+		cfg.LogFormat = v
+	}
+	if v := getenv("DRY_RUN"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("read params errors: DRY_RUN: %w", err)
+		}
+		cfg.DryRun = b
+	}
+	if v := getenv("PREFLIGHT"); v != "" {
+		switch v {
+		case PreflightOff, PreflightDisable, PreflightFail:
+			cfg.Preflight = v
+		default:
+			return nil, fmt.Errorf("read params errors: PREFLIGHT: expected off, disable or fail, got %q", v)
+		}
+	}
+	if v := getenv("CLICKHOUSE_ADD_COLUMNS"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("read params errors: CLICKHOUSE_ADD_COLUMNS: %w", err)
+		}
+		cfg.ClickhouseAddColumns = b
+	}
+	if v := getenv("CLICKHOUSE_DATABASE"); v != "" {
+		cfg.ClickhouseDatabase = v
+	}
+	if v := getenv("CLICKHOUSE_TABLE_PREFIX"); v != "" {
+		cfg.ClickhouseTablePrefix = v
+	}
+	if v := getenv("CLICKHOUSE_DIRECT_INSERT"); v != "" {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if !knownCollector(name) {
+				return nil, fmt.Errorf("read params errors: CLICKHOUSE_DIRECT_INSERT: unknown collector %q", name)
+			}
+			cfg.ClickhouseDirectInsert = append(cfg.ClickhouseDirectInsert, name)
+		}
+	}
+	if v := getenv("CLICKHOUSE_INSERT_DEDUPLICATION"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("read params errors: CLICKHOUSE_INSERT_DEDUPLICATION: %w", err)
+		}
+		cfg.ClickhouseInsertDeduplication = b
+	}
+	if v := getenv("LABELS"); v != "" {
+		labels, err := parseLabels(v)
+		if err != nil {
+			return nil, fmt.Errorf("read params errors: LABELS: %w", err)
+		}
+		cfg.Labels = labels
+	}
+	if v := getenv("DISCOVER_CLUSTER_NAME"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("read params errors: DISCOVER_CLUSTER_NAME: %w", err)
+		}
+		cfg.Labels.DiscoverCluster = b
+	}
+	if err := intEnv(getenv, "PUSH_MAX_ROWS", &cfg.PushMaxRows); err != nil {
+		return nil, err
+	}
+	if cfg.PushMaxRows <= 0 {
+		return nil, fmt.Errorf("read params errors: PUSH_MAX_ROWS should be positive, got %d", cfg.PushMaxRows)
+	}
+	if err := intEnv(getenv, "PUSH_MAX_BYTES", &cfg.PushMaxBytes); err != nil {
+		return nil, err
+	}
+	if err := intEnv(getenv, "PUSH_RETRIES", &cfg.PushRetries); err != nil {
+		return nil, err
+	}
+	if cfg.PushMaxBytes < 0 || cfg.PushRetries < 0 {
+		return nil, fmt.Errorf("read params errors: PUSH_MAX_BYTES and PUSH_RETRIES should not be negative")
+	}
+	if err := intEnv(getenv, "PLAN_SAMPLE_TOP", &cfg.PlanSampleTop); err != nil {
+		return nil, err
+	}
+	if cfg.PlanSampleTop < 0 {
+		return nil, fmt.Errorf("read params errors: PLAN_SAMPLE_TOP should not be negative, got %d", cfg.PlanSampleTop)
+	}
+	if err := floatEnv(getenv, "REGRESSION_FACTOR", &cfg.RegressionFactor); err != nil {
+		return nil, err
+	}
+	if cfg.RegressionFactor != 0 && cfg.RegressionFactor <= 1 {
+		return nil, fmt.Errorf("read params errors: REGRESSION_FACTOR should be greater than 1, got %g", cfg.RegressionFactor)
+	}
+	if err := intEnv(getenv, "REGRESSION_MIN_CALLS", &cfg.RegressionMinCalls); err != nil {
+		return nil, err
+	}
+	if cfg.RegressionMinCalls < 0 {
+		return nil, fmt.Errorf("read params errors: REGRESSION_MIN_CALLS should not be negative, got %d", cfg.RegressionMinCalls)
+	}
+	if v := getenv("REGRESSION_WEBHOOK"); v != "" {
+		cfg.RegressionWebhook = v
+	}
+	if v := getenv("ALERT_RULES"); v != "" {
+		rules, err := parseAlertRules(v)
+		if err != nil {
+			return nil, fmt.Errorf("read params errors: ALERT_RULES: %w", err)
+		}
+		cfg.AlertRules = rules
+	}
+	if err := durationEnv(getenv, "ALERT_COOLDOWN", &cfg.AlertCooldown); err != nil {
+		return nil, err
+	}
+	if v := getenv("ALERT_WEBHOOK"); v != "" {
+		cfg.AlertWebhook = v
+	}
+	if v := getenv("ALERT_WEBHOOK_FORMAT"); v != "" {
+		switch v {
+		case AlertFormatAlertmanager, AlertFormatSlack:
+			cfg.AlertWebhookFormat = v
+		default:
+			return nil, fmt.Errorf("read params errors: ALERT_WEBHOOK_FORMAT: expected alertmanager or slack, got %q", v)
+		}
+	}
+	if err := intEnv(getenv, "DISK_CAPACITY", &cfg.DiskCapacity); err != nil {
+		return nil, err
+	}
+	if cfg.DiskCapacity < 0 {
+		return nil, fmt.Errorf("read params errors: DISK_CAPACITY should not be negative, got %d", cfg.DiskCapacity)
+	}
+	if err := durationEnv(getenv, "SHUTDOWN_TIMEOUT", &cfg.ShutdownTimeout); err != nil {
+		return nil, err
+	}
+	if v := getenv("SHUTDOWN_FLUSH"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("read params errors: SHUTDOWN_FLUSH: %w", err)
+		}
+		cfg.ShutdownFlush = b
+	}
 	return cfg, nil
 }
+
+// clickhouseTables - таблицы коллектора с учетом базы, префикса, CLICKHOUSE_DIRECT_INSERT и CLICKHOUSE_INSERT_DEDUPLICATION
+func (cfg *Config) clickhouseTables(collector string) ClickhouseTables {
+	tables := ClickhouseTables{Database: cfg.ClickhouseDatabase, Prefix: cfg.ClickhouseTablePrefix, Deduplicate: cfg.ClickhouseInsertDeduplication}
+	for _, name := range cfg.ClickhouseDirectInsert {
+		if name == collector {
+			tables.Direct = true
+		}
+	}
+	return tables
+}
+
+func knownCollector(name string) bool {
+	for _, f := range collectorFactories {
+		if f.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+func durationEnv(getenv func(string) string, name string, dst *time.Duration) error {
+	v := getenv(name)
+	if v == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("read params errors: %s: %w", name, err)
+	}
+	*dst = d
+	return nil
+}
+
+func intEnv(getenv func(string) string, name string, dst *int) error {
+	v := getenv(name)
+	if v == "" {
+		return nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("read params errors: %s: %w", name, err)
+	}
+	*dst = i
+	return nil
+}
+
+func floatEnv(getenv func(string) string, name string, dst *float64) error {
+	v := getenv(name)
+	if v == "" {
+		return nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return fmt.Errorf("read params errors: %s: %w", name, err)
+	}
+	*dst = f
+	return nil
+}
+
+// readConfigFile - файл в формате env-file: KEY=VALUE, пустые строки и строки с # пропускаются
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, i+1)
+		}
+		values[strings.TrimSpace(kv[0])] = strings.Trim(strings.TrimSpace(kv[1]), `"'`)
+	}
+	return values, nil
+}
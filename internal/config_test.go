@@ -1,8 +1,10 @@
 package internal
 
 import (
+	"flag"
 	"github.com/stretchr/testify/assert"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -28,3 +30,296 @@ func TestNewConfig(t *testing.T) {
 	assert.Equal(t, actualConfig.PostgresDsn, givenPostgresDsn, "Not correct Interval parsed")
 	assert.Equal(t, actualConfig.ClickhouseDsn, givenClickhouseDsn, "Not correct Interval parsed")
 }
+
+func TestNewConfig_Backoff(t *testing.T) {
+	t.Setenv("BACKOFF_MIN", "500ms")
+	t.Setenv("BACKOFF_MAX", "2m")
+	t.Setenv("BREAKER_THRESHOLD", "5")
+
+	actualConfig, err := NewConfig()
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	assert.Equal(t, 500*time.Millisecond, actualConfig.BackoffMin, "Not correct BackoffMin parsed")
+	assert.Equal(t, 2*time.Minute, actualConfig.BackoffMax, "Not correct BackoffMax parsed")
+	assert.Equal(t, 5, actualConfig.BreakerThreshold, "Not correct BreakerThreshold parsed")
+
+	t.Setenv("BREAKER_THRESHOLD", "five")
+	_, err = NewConfig()
+	assert.Error(t, err, "expected parse error")
+}
+
+func TestNewConfig_Push(t *testing.T) {
+	actualConfig, err := NewConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, 10000, actualConfig.PushMaxRows)
+	assert.Equal(t, 16<<20, actualConfig.PushMaxBytes)
+	assert.Equal(t, 2, actualConfig.PushRetries)
+
+	t.Setenv("PUSH_MAX_ROWS", "500")
+	t.Setenv("PUSH_MAX_BYTES", "0")
+	t.Setenv("PUSH_RETRIES", "0")
+	actualConfig, err = NewConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, 500, actualConfig.PushMaxRows)
+	assert.Equal(t, 0, actualConfig.PushMaxBytes)
+	assert.Equal(t, 0, actualConfig.PushRetries)
+
+	t.Setenv("PUSH_MAX_ROWS", "0")
+	_, err = NewConfig()
+	assert.Error(t, err, "expected positive PUSH_MAX_ROWS")
+
+	t.Setenv("PUSH_MAX_ROWS", "500")
+	t.Setenv("PUSH_RETRIES", "-1")
+	_, err = NewConfig()
+	assert.Error(t, err, "expected not negative PUSH_RETRIES")
+}
+
+func TestNewConfig_PlanSampleTop(t *testing.T) {
+	actualConfig, err := NewConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, actualConfig.PlanSampleTop, "disabled by default")
+
+	t.Setenv("PLAN_SAMPLE_TOP", "10")
+	actualConfig, err = NewConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, 10, actualConfig.PlanSampleTop)
+
+	t.Setenv("PLAN_SAMPLE_TOP", "-1")
+	_, err = NewConfig()
+	assert.Error(t, err, "expected not negative PLAN_SAMPLE_TOP")
+}
+
+func TestNewConfig_Regression(t *testing.T) {
+	actualConfig, err := NewConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, float64(0), actualConfig.RegressionFactor, "disabled by default")
+	assert.Equal(t, defaultRegressionMinCalls, actualConfig.RegressionMinCalls)
+
+	t.Setenv("REGRESSION_FACTOR", "2.5")
+	t.Setenv("REGRESSION_MIN_CALLS", "100")
+	t.Setenv("REGRESSION_WEBHOOK", "http://alerts.local/hook")
+	actualConfig, err = NewConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, 2.5, actualConfig.RegressionFactor)
+	assert.Equal(t, 100, actualConfig.RegressionMinCalls)
+	assert.Equal(t, "http://alerts.local/hook", actualConfig.RegressionWebhook)
+
+	t.Setenv("REGRESSION_FACTOR", "0.5")
+	_, err = NewConfig()
+	assert.Error(t, err, "expected REGRESSION_FACTOR greater than 1")
+
+	t.Setenv("REGRESSION_FACTOR", "2")
+	t.Setenv("REGRESSION_MIN_CALLS", "-1")
+	_, err = NewConfig()
+	assert.Error(t, err, "expected not negative REGRESSION_MIN_CALLS")
+}
+
+func TestNewConfig_Alerts(t *testing.T) {
+	actualConfig, err := NewConfig()
+	assert.NoError(t, err)
+	assert.Empty(t, actualConfig.AlertRules)
+	assert.Equal(t, time.Hour, actualConfig.AlertCooldown)
+	assert.Equal(t, AlertFormatAlertmanager, actualConfig.AlertWebhookFormat)
+
+	t.Setenv("ALERT_RULES", "PgStatStatements: temp_blks_written > 100000; PgTableSize: rate(size) > 1e9")
+	t.Setenv("ALERT_COOLDOWN", "30m")
+	t.Setenv("ALERT_WEBHOOK", "http://alertmanager:9093/api/v2/alerts")
+	t.Setenv("ALERT_WEBHOOK_FORMAT", "slack")
+	actualConfig, err = NewConfig()
+	assert.NoError(t, err)
+	assert.Len(t, actualConfig.AlertRules, 2)
+	assert.Equal(t, 30*time.Minute, actualConfig.AlertCooldown)
+	assert.Equal(t, "http://alertmanager:9093/api/v2/alerts", actualConfig.AlertWebhook)
+	assert.Equal(t, AlertFormatSlack, actualConfig.AlertWebhookFormat)
+
+	t.Setenv("ALERT_WEBHOOK_FORMAT", "teams")
+	_, err = NewConfig()
+	assert.Error(t, err)
+
+	t.Setenv("ALERT_WEBHOOK_FORMAT", "")
+	t.Setenv("ALERT_RULES", "PgTableSize: tablename > 1")
+	_, err = NewConfig()
+	assert.Error(t, err, "expected numeric column")
+}
+
+func TestNewConfig_DiskCapacity(t *testing.T) {
+	t.Setenv("DISK_CAPACITY", "536870912000")
+	actualConfig, err := NewConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, 536870912000, actualConfig.DiskCapacity)
+	assert.Equal(t, float64(536870912000), CollectorSpecs(actualConfig)[2].Factory.(*PgTableSizeFactory).DiskCapacity)
+
+	t.Setenv("DISK_CAPACITY", "-1")
+	_, err = NewConfig()
+	assert.Error(t, err, "expected not negative DISK_CAPACITY")
+}
+
+func TestNewConfig_Timeouts(t *testing.T) {
+	t.Setenv("COLLECT_TIMEOUT", "20s")
+	t.Setenv("STATEMENT_TIMEOUT", "5s")
+	t.Setenv("LOCK_TIMEOUT", "100ms")
+
+	actualConfig, err := NewConfig()
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	assert.Equal(t, 20*time.Second, actualConfig.CollectTimeout, "Not correct CollectTimeout parsed")
+	assert.Equal(t, 5*time.Second, actualConfig.StatementTimeout, "Not correct StatementTimeout parsed")
+	assert.Equal(t, 100*time.Millisecond, actualConfig.LockTimeout, "Not correct LockTimeout parsed")
+
+	t.Setenv("LOCK_TIMEOUT", "100")
+	_, err = NewConfig()
+	assert.Error(t, err, "expected parse error")
+}
+
+func TestNewConfig_DryRun(t *testing.T) {
+	t.Setenv("DRY_RUN", "true")
+
+	actualConfig, err := NewConfig()
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	assert.True(t, actualConfig.DryRun, "Not correct DryRun parsed")
+
+	t.Setenv("DRY_RUN", "yes")
+	_, err = NewConfig()
+	assert.Error(t, err, "expected parse error")
+}
+
+func TestNewConfig_Preflight(t *testing.T) {
+	actualConfig, err := NewConfig()
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	assert.Equal(t, PreflightDisable, actualConfig.Preflight, "Not correct default Preflight")
+
+	t.Setenv("PREFLIGHT", "fail")
+	actualConfig, err = NewConfig()
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	assert.Equal(t, PreflightFail, actualConfig.Preflight, "Not correct Preflight parsed")
+
+	t.Setenv("PREFLIGHT", "warn")
+	_, err = NewConfig()
+	assert.Error(t, err, "expected parse error")
+}
+
+func TestNewConfig_ClickhouseTables(t *testing.T) {
+	actualConfig, err := NewConfig()
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	assert.Equal(t, "pg", actualConfig.ClickhouseDatabase, "Not correct default ClickhouseDatabase")
+
+	t.Setenv("CLICKHOUSE_DATABASE", "stats")
+	t.Setenv("CLICKHOUSE_TABLE_PREFIX", "staging_")
+	t.Setenv("CLICKHOUSE_DIRECT_INSERT", "PgTableSize, PgStatioTable")
+	actualConfig, err = NewConfig()
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	assert.Equal(t, "stats", actualConfig.ClickhouseDatabase)
+	assert.Equal(t, "staging_", actualConfig.ClickhouseTablePrefix)
+	assert.Equal(t, []string{"PgTableSize", "PgStatioTable"}, actualConfig.ClickhouseDirectInsert)
+	assert.True(t, actualConfig.ClickhouseInsertDeduplication)
+
+	t.Setenv("CLICKHOUSE_INSERT_DEDUPLICATION", "false")
+	actualConfig, err = NewConfig()
+	assert.NoError(t, err)
+	assert.False(t, actualConfig.ClickhouseInsertDeduplication)
+
+	t.Setenv("CLICKHOUSE_DIRECT_INSERT", "PgTableSizes")
+	_, err = NewConfig()
+	assert.Error(t, err, "expected unknown collector error")
+}
+
+func TestNewConfig_Labels(t *testing.T) {
+	t.Setenv("LABELS", "cluster=main,role=replica")
+
+	actualConfig, err := NewConfig()
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	assert.Equal(t, Labels{Cluster: "main", Role: "replica"}, actualConfig.Labels, "Not correct Labels parsed")
+
+	t.Setenv("DISCOVER_CLUSTER_NAME", "true")
+	actualConfig, err = NewConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, Labels{Cluster: "main", Role: "replica", DiscoverCluster: true}, actualConfig.Labels, "DISCOVER_CLUSTER_NAME is lost")
+
+	t.Setenv("LABELS", "zone=a")
+	_, err = NewConfig()
+	assert.Error(t, err, "expected parse error")
+}
+
+func TestNewConfig_ConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pgstats.env")
+	content := `# overrides ENV
+INTERVAL=15s
+CLICKHOUSE_DSN="http://clickhouse:8123/default"
+
+`
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("INTERVAL", "60s")
+	t.Setenv("POSTGRES_DSN", "mock_postgresDsn")
+
+	actualConfig, err := NewConfig()
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	assert.Equal(t, 15*time.Second, actualConfig.Interval, "config file should override ENV")
+	assert.Equal(t, "http://clickhouse:8123/default", actualConfig.ClickhouseDsn, "quotes should be trimmed")
+	assert.Equal(t, "mock_postgresDsn", actualConfig.PostgresDsn, "ENV should be used if not in config file")
+
+	assert.NoError(t, os.WriteFile(path, []byte("INTERVAL"), 0644))
+	_, err = NewConfig()
+	assert.Error(t, err, "expected config file parse error")
+}
+
+func TestConfigFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pgstats.env")
+	assert.NoError(t, os.WriteFile(path, []byte("INTERVAL=15s\nLOG_LEVEL=warn\n"), 0644))
+	t.Setenv("INTERVAL", "60s")
+	t.Setenv("POSTGRES_DSN", "mock_postgresDsn")
+	t.Setenv("LOG_LEVEL", "error")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags := RegisterConfigFlags(fs)
+	err := fs.Parse([]string{"--config", path, "--interval=5s", "--dry-run", "--shutdown-flush=false"})
+	assert.NoError(t, err)
+
+	actualConfig, err := flags.NewConfig()
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	assert.Equal(t, 5*time.Second, actualConfig.Interval, "flag should override config file and ENV")
+	assert.Equal(t, "warn", actualConfig.LogLevel, "config file should be read from --config")
+	assert.Equal(t, "mock_postgresDsn", actualConfig.PostgresDsn, "ENV should be used if no flag")
+	assert.True(t, actualConfig.DryRun)
+	assert.False(t, actualConfig.ShutdownFlush)
+}
+
+func TestConfigUsage(t *testing.T) {
+	usage := ConfigUsage()
+	for _, p := range configParams {
+		assert.Contains(t, usage, p.env+", --"+p.flagName()+" - ")
+	}
+	assert.Contains(t, usage, "CONFIG_FILE, --config - ")
+	assert.Contains(t, usage, "POSTGRES_DSN, --postgres-dsn - ")
+}
@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+var defaultReadyIntervals = 3
+
+// NewHTTPServer - служебный http сервер демона:
+//
+//	POST /-/reload - перечитать конфиг, как по SIGHUP
+//	GET /healthz - liveness: процесс жив и ни один тик не завис
+//	GET /readyz - readiness: у всех включенных коллекторов был успешный тик за последние readyIntervals интервалов
+func NewHTTPServer(addr string, supervisor *Supervisor, reload func() error, readyIntervals int) *http.Server {
+	if readyIntervals <= 0 {
+		readyIntervals = defaultReadyIntervals
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/-/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, supervisor.Status())
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeProbe(w, supervisor.Status(), checkAlive)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeProbe(w, supervisor.Status(), func(status CollectorStatus, now time.Time) error {
+			return checkReady(status, now, readyIntervals)
+		})
+	})
+	return &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+}
+
+type probeResponse struct {
+	Status     string           `json:"status"`
+	Collectors []collectorProbe `json:"collectors"`
+}
+
+type collectorProbe struct {
+	CollectorStatus
+	OK     bool   `json:"ok"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func writeProbe(w http.ResponseWriter, statuses []CollectorStatus, check func(CollectorStatus, time.Time) error) {
+	now := time.Now()
+	response := probeResponse{
+		Status:     "ok",
+		Collectors: make([]collectorProbe, 0, len(statuses)),
+	}
+	code := http.StatusOK
+	for _, status := range statuses {
+		probe := collectorProbe{CollectorStatus: status, OK: true}
+		if err := check(status, now); err != nil {
+			probe.OK = false
+			probe.Reason = err.Error()
+			response.Status = "fail"
+			code = http.StatusServiceUnavailable
+		}
+		response.Collectors = append(response.Collectors, probe)
+	}
+	writeJSON(w, code, response)
+}
+
+// checkAlive - тик висит дольше двух своих deadline-ов, значит цикл коллектора завис
+func checkAlive(status CollectorStatus, now time.Time) error {
+	if status.InFlightSince == nil {
+		return nil
+	}
+	limit := status.interval
+	if status.timeout > limit {
+		limit = status.timeout
+	}
+	if running := now.Sub(*status.InFlightSince); running > 2*limit {
+		return fmt.Errorf("tick is running for %s", running.Round(time.Second))
+	}
+	return nil
+}
+
+func checkReady(status CollectorStatus, now time.Time, intervals int) error {
+	if status.State == StateDisabled {
+		// выключенный коллектор виден в detail, но не держит pod неготовым
+		return nil
+	}
+	if status.LastSuccess.IsZero() {
+		return fmt.Errorf("no successful tick yet, state: %s", status.State)
+	}
+	if since := now.Sub(status.LastSuccess); since > time.Duration(intervals)*status.interval {
+		return fmt.Errorf("last successful tick was %s ago", since.Round(time.Second))
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("http response write failed", "error", err)
+	}
+}
@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHTTPServer_Reload(t *testing.T) {
+	reloaded := 0
+	server := NewHTTPServer(":0", NewSupervisor(getDownConfig(), "hostname"), func() error {
+		reloaded++
+		return nil
+	}, 0)
+
+	w := httptest.NewRecorder()
+	server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/-/reload", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, 0, reloaded, "GET should not reload config")
+
+	w = httptest.NewRecorder()
+	server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/-/reload", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, 1, reloaded)
+}
+
+func TestHTTPServer_Reload_Error(t *testing.T) {
+	server := NewHTTPServer(":0", NewSupervisor(getDownConfig(), "hostname"), func() error {
+		return errors.New("bad config")
+	}, 0)
+
+	w := httptest.NewRecorder()
+	server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/-/reload", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Contains(t, w.Body.String(), "bad config")
+}
+
+func TestCheckAlive(t *testing.T) {
+	now := time.Now()
+	started := now.Add(-time.Minute)
+	given := CollectorStatus{interval: 10 * time.Second, timeout: 20 * time.Second}
+
+	assert.NoError(t, checkAlive(given, now), "collector without tick in flight is alive")
+
+	given.InFlightSince = &started
+	assert.Error(t, checkAlive(given, now), "tick running for 3 timeouts is wedged")
+
+	given.timeout = time.Minute
+	assert.NoError(t, checkAlive(given, now), "tick within 2 timeouts is not wedged")
+}
+
+func TestCheckReady(t *testing.T) {
+	now := time.Now()
+	given := CollectorStatus{State: StateNotReady, interval: 10 * time.Second}
+
+	assert.Error(t, checkReady(given, now, 3), "collector without successful tick is not ready")
+
+	given.LastSuccess = now.Add(-25 * time.Second)
+	assert.NoError(t, checkReady(given, now, 3))
+
+	given.LastSuccess = now.Add(-35 * time.Second)
+	assert.Error(t, checkReady(given, now, 3), "last successful tick is older than 3 intervals")
+
+	given = CollectorStatus{State: StateDisabled, interval: 10 * time.Second}
+	assert.NoError(t, checkReady(given, now, 3), "disabled collector should not fail readiness")
+}
+
+func TestHTTPServer_Probes(t *testing.T) {
+	supervisor := NewSupervisor(getDownConfig(), "hostname")
+	supervisor.collectors["PgStatStatements"] = &supervised{
+		spec:     CollectorSpec{Factory: &PgStatStatementsFactory{}},
+		settings: collectorSettings{interval: time.Second},
+		state:    StateStarting,
+	}
+	server := NewHTTPServer(":0", supervisor, func() error { return nil }, 3)
+
+	w := httptest.NewRecorder()
+	server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	var response probeResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "fail", response.Status)
+	assert.Len(t, response.Collectors, 1)
+	assert.Equal(t, "PgStatStatements", response.Collectors[0].Name)
+	assert.False(t, response.Collectors[0].OK)
+	assert.NotEmpty(t, response.Collectors[0].Reason)
+}
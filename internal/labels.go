@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Labels - статичные метки инстанса из конфига, пишутся в LowCardinality колонки каждой строки метрик.
+// Незаданные метки не попадают в INSERT, поэтому без них работают и таблицы без этих колонок.
+// Колонка pg_role пишется всегда, ее значение берется из инстанса на каждом тике
+type Labels struct {
+	Cluster     string
+	Environment string
+	Role        string
+	Shard       string
+	Datacenter  string
+	// DiscoverCluster - пустой Cluster заполняется из GUC cluster_name, колонка cluster тогда пишется всегда
+	DiscoverCluster bool
+
+	pgRole string
+}
+
+// labelNames - имена меток в LABELS, они же колонки clickhouse
+var labelNames = []string{"cluster", "environment", "role", "shard", "datacenter"}
+
+func (l *Labels) field(name string) *string {
+	switch name {
+	case "cluster":
+		return &l.Cluster
+	case "environment":
+		return &l.Environment
+	case "role":
+		return &l.Role
+	case "shard":
+		return &l.Shard
+	case "datacenter":
+		return &l.Datacenter
+	}
+	return nil
+}
+
+// written - метка попадает в INSERT: задана в конфиге или ищется в инстансе
+func (l *Labels) written(name string) bool {
+	return *l.field(name) != "" || (name == "cluster" && l.DiscoverCluster)
+}
+
+// columns - pg_role и колонки заданных меток
+func (l Labels) columns() []string {
+	columns := []string{"pg_role"}
+	for _, name := range labelNames {
+		if l.written(name) {
+			columns = append(columns, name)
+		}
+	}
+	return columns
+}
+
+// values - значения в порядке columns
+func (l Labels) values() []interface{} {
+	values := []interface{}{l.pgRole}
+	for _, name := range labelNames {
+		if l.written(name) {
+			values = append(values, *l.field(name))
+		}
+	}
+	return values
+}
+
+// toMap - columns и values для JSON вебхуков, пустые метки не пишутся
+func (l Labels) toMap() map[string]string {
+	m := make(map[string]string)
+	values := l.values()
+	for i, name := range l.columns() {
+		if v := values[i].(string); v != "" {
+			m[name] = v
+		}
+	}
+	return m
+}
+
+// withInstance - метки для строк тика: роль инстанса и, с DiscoverCluster, его cluster_name.
+// До первого подключения инстанс неизвестен, pg_role пустая
+func (l Labels) withInstance(instance *PgInstance) Labels {
+	if instance == nil {
+		return l
+	}
+	l.pgRole = instance.role()
+	if l.DiscoverCluster && l.Cluster == "" {
+		l.Cluster = instance.ClusterName
+	}
+	return l
+}
+
+// parseLabels разбирает "cluster=main,environment=prod"
+func parseLabels(s string) (Labels, error) {
+	var labels Labels
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return labels, fmt.Errorf("expected name=value, got %q", pair)
+		}
+		field := labels.field(strings.TrimSpace(kv[0]))
+		if field == nil {
+			return labels, fmt.Errorf("unknown label %q, expected one of %s", strings.TrimSpace(kv[0]), strings.Join(labelNames, ", "))
+		}
+		*field = strings.TrimSpace(kv[1])
+	}
+	return labels, nil
+}
+
+// rowColumns - колонки строки INSERT-а: колонки коллектора, pg_role и заданные метки
+func rowColumns(cf CollectorFactory, labels Labels) []string {
+	return append(cf.PushColumns(), labels.columns()...)
+}
+
+// rowValues - значения строки INSERT-а в порядке rowColumns
+func rowValues(metric PgMetric, hostname string, labels Labels) []interface{} {
+	return append(metric.getValue(hostname), labels.values()...)
+}
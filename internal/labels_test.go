@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseLabels(t *testing.T) {
+	labels, err := parseLabels("cluster=main, environment = prod,,datacenter=dc1")
+	assert.NoError(t, err)
+	assert.Equal(t, Labels{Cluster: "main", Environment: "prod", Datacenter: "dc1"}, labels)
+	assert.Equal(t, []string{"pg_role", "cluster", "environment", "datacenter"}, labels.columns())
+	assert.Equal(t, []interface{}{"", "main", "prod", "dc1"}, labels.values())
+
+	_, err = parseLabels("region=eu")
+	assert.Error(t, err, "expected unknown label error")
+
+	_, err = parseLabels("cluster")
+	assert.Error(t, err, "expected parse error")
+}
+
+func TestRowValues(t *testing.T) {
+	labels := Labels{Role: "replica"}
+	metric := getMockPgTableSize()
+
+	columns := rowColumns(&PgTableSizeFactory{}, labels)
+	values := rowValues(metric, "hostname", labels)
+	assert.Len(t, values, len(columns))
+	assert.Equal(t, "role", columns[len(columns)-1])
+	assert.Equal(t, "replica", values[len(values)-1])
+
+	assert.Equal(t, append((&PgTableSizeFactory{}).PushColumns(), "pg_role"), rowColumns(&PgTableSizeFactory{}, Labels{}), "no labels - only pg_role")
+}
+
+func TestLabels_WithInstance(t *testing.T) {
+	primary := &PgInstance{SystemIdentifier: "1", ClusterName: "main"}
+	standby := &PgInstance{SystemIdentifier: "1", InRecovery: true, ClusterName: "main"}
+
+	assert.Equal(t, []interface{}{"primary"}, Labels{}.withInstance(primary).values())
+	assert.Equal(t, []interface{}{"standby"}, Labels{}.withInstance(standby).values())
+	assert.Equal(t, []interface{}{""}, Labels{}.withInstance(nil).values(), "instance is unknown yet")
+
+	discover := Labels{DiscoverCluster: true}
+	assert.Equal(t, []string{"pg_role", "cluster"}, discover.columns(), "cluster column is written before discovery")
+	assert.Equal(t, []interface{}{"standby", "main"}, discover.withInstance(standby).values())
+	assert.Equal(t, []interface{}{"primary", ""}, discover.withInstance(&PgInstance{}).values(), "cluster_name is not set")
+
+	static := Labels{Cluster: "static", DiscoverCluster: true}
+	assert.Equal(t, []interface{}{"primary", "static"}, static.withInstance(primary).values(), "LABELS has priority")
+}
+
+func TestLabels_ToMap(t *testing.T) {
+	labels := Labels{Cluster: "main", Shard: "1"}.withInstance(&PgInstance{InRecovery: true})
+	assert.Equal(t, map[string]string{"pg_role": "standby", "cluster": "main", "shard": "1"}, labels.toMap())
+	assert.Equal(t, map[string]string{}, Labels{}.withInstance(nil).toMap(), "empty labels are not written")
+}
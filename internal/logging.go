@@ -0,0 +1,36 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// logLevel - общий уровень логирования, меняется при reload-е конфига без пересоздания логгера
+var logLevel = new(slog.LevelVar)
+
+// NewLogger - логгер в формате text или json с уровнем level (debug, info, warn, error)
+func NewLogger(w io.Writer, level string, format string) (*slog.Logger, error) {
+	if err := SetLogLevel(level); err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{Level: logLevel}
+	switch strings.ToLower(format) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q, expected text or json", format)
+}
+
+// SetLogLevel меняет уровень логирования всех логгеров, созданных NewLogger
+func SetLogLevel(level string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("unknown log level %q: %w", level, err)
+	}
+	logLevel.Set(l)
+	return nil
+}
@@ -0,0 +1,45 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNewLogger_JSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := NewLogger(&buf, "info", "json")
+	assert.NoError(t, err)
+
+	logger.Debug("hidden")
+	logger.Info("tick done", "collector", "PgStatStatements", "rows", 10)
+
+	var record map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &record), "expected exactly one json record")
+	assert.Equal(t, "tick done", record["msg"])
+	assert.Equal(t, "PgStatStatements", record["collector"])
+	assert.Equal(t, float64(10), record["rows"])
+}
+
+func TestNewLogger_Level(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := NewLogger(&buf, "warn", "text")
+	assert.NoError(t, err)
+
+	logger.Info("hidden")
+	assert.Empty(t, buf.String(), "info should be filtered by warn level")
+
+	assert.NoError(t, SetLogLevel("debug"))
+	logger.Debug("shown")
+	assert.Contains(t, buf.String(), "shown", "level should be changed for existing logger")
+	assert.NoError(t, SetLogLevel("info"))
+}
+
+func TestNewLogger_Invalid(t *testing.T) {
+	_, err := NewLogger(&bytes.Buffer{}, "verbose", "text")
+	assert.Error(t, err)
+
+	_, err = NewLogger(&bytes.Buffer{}, "info", "xml")
+	assert.Error(t, err)
+}
@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// Migrate применяет к clickhouse все *.sql из migrations по порядку имен, подставляя базу и префикс таблиц.
+// DDL написаны с IF NOT EXISTS, поэтому повторный запуск безопасен
+func Migrate(ctx context.Context, clickhouseDsn string, migrations fs.FS, tables ClickhouseTables) error {
+	files, err := fs.Glob(migrations, "*/*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+
+	ch, err := sql.Open("clickhouse", clickhouseDsn)
+	if err != nil {
+		return fmt.Errorf("invalid clickhouse dsn: %w", err)
+	}
+	defer ch.Close()
+
+	for _, file := range files {
+		script, err := renderMigration(migrations, file, tables)
+		if err != nil {
+			return err
+		}
+		for i, stmt := range splitStatements(script) {
+			slog.Debug("migrate", "file", file, "statement", i+1, "sql", stmt)
+			if _, err = ch.ExecContext(ctx, stmt); err != nil {
+				return fmt.Errorf("%s: statement %d failed with: %w", file, i+1, err)
+			}
+		}
+		slog.Info("migration applied", "file", file)
+	}
+	return nil
+}
+
+// renderMigration - миграции это text/template с полями ClickhouseTables и функцией zooKeeperPath
+func renderMigration(migrations fs.FS, file string, tables ClickhouseTables) (string, error) {
+	data, err := fs.ReadFile(migrations, file)
+	if err != nil {
+		return "", err
+	}
+	tmpl, err := template.New(file).
+		Funcs(template.FuncMap{"zooKeeperPath": tables.zooKeeperPath}).
+		Option("missingkey=error").
+		Parse(string(data))
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", file, err)
+	}
+	var script strings.Builder
+	if err = tmpl.Execute(&script, tables); err != nil {
+		return "", fmt.Errorf("%s: %w", file, err)
+	}
+	return script.String(), nil
+}
+
+// splitStatements делит sql-скрипт по ";" в конце строки, строки-комментарии "--" выкидываются
+func splitStatements(script string) []string {
+	var (
+		statements []string
+		current    strings.Builder
+	)
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		current.WriteString(line)
+		current.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			statements = append(statements, strings.TrimSuffix(strings.TrimSpace(current.String()), ";"))
+			current.Reset()
+		}
+	}
+	if rest := strings.TrimSpace(current.String()); rest != "" {
+		statements = append(statements, rest)
+	}
+	return statements
+}
@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"github.com/chobostar/pgstats-to-clickhouse/db/migrations"
+	"github.com/stretchr/testify/assert"
+	"io/fs"
+	"strings"
+	"testing"
+)
+
+func TestSplitStatements(t *testing.T) {
+	script := `CREATE DATABASE IF NOT EXISTS pg;
+
+--comment;
+CREATE TABLE pg.t (
+    a UInt8
+) ENGINE = Memory;
+SELECT 1`
+
+	assert.Equal(t, []string{
+		"CREATE DATABASE IF NOT EXISTS pg",
+		"CREATE TABLE pg.t (\n    a UInt8\n) ENGINE = Memory",
+		"SELECT 1",
+	}, splitStatements(script))
+}
+
+func TestMigrations_Embedded(t *testing.T) {
+	files, err := fs.Glob(migrations.ClickHouse, "*/*.sql")
+	assert.NoError(t, err)
+	assert.Equal(t, "clickhouse/001_init.sql", files[0], "init should go first")
+
+	script, err := renderMigration(migrations.ClickHouse, files[0], ClickhouseTables{Database: "pg"})
+	assert.NoError(t, err)
+	assert.Contains(t, script, "CREATE TABLE IF NOT EXISTS pg.pg_stat_statements_buffer AS pg.pg_stat_statements ENGINE = Buffer(pg, pg_stat_statements,")
+	assert.Contains(t, script, "ReplicatedMergeTree('/clickhouse/{cluster}/tables/{shard}/pg_stat_statements', '{replica}')")
+	for _, file := range files {
+		script, err := renderMigration(migrations.ClickHouse, file, ClickhouseTables{Database: "pg"})
+		assert.NoError(t, err, file)
+		for _, stmt := range splitStatements(script) {
+			assert.True(t, strings.HasPrefix(stmt, "CREATE ") || strings.HasPrefix(stmt, "ALTER TABLE pg."), "%s: unexpected statement: %s", file, stmt)
+		}
+	}
+
+	script, err = renderMigration(migrations.ClickHouse, files[0], ClickhouseTables{Database: "stats", Prefix: "staging_"})
+	assert.NoError(t, err)
+	assert.Contains(t, script, "CREATE DATABASE IF NOT EXISTS stats")
+	assert.Contains(t, script, "CREATE TABLE IF NOT EXISTS stats.staging_pg_table_size_buffer AS stats.staging_pg_table_size ENGINE = Buffer(stats, staging_pg_table_size,")
+	assert.Contains(t, script, "ReplicatedMergeTree('/clickhouse/{cluster}/tables/{shard}/stats/staging_pg_table_size', '{replica}')")
+	assert.NotContains(t, script, " pg.")
+}
@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+)
+
+// WriteMetrics печатает метрики в виде строк, которые ушли бы в clickhouse: json, csv или table
+func WriteMetrics(w io.Writer, format string, cf CollectorFactory, hostname string, labels Labels, metrics []PgMetric) error {
+	columns := rowColumns(cf, labels)
+	switch format {
+	case "json":
+		rows := make([]map[string]interface{}, 0, len(metrics))
+		for _, metric := range metrics {
+			row := make(map[string]interface{}, len(columns))
+			for i, v := range rowValues(metric, hostname, labels) {
+				row[columns[i]] = plainValue(v)
+			}
+			rows = append(rows, row)
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rows)
+	case "csv":
+		cw := csv.NewWriter(w)
+		if err := cw.Write(columns); err != nil {
+			return err
+		}
+		for _, metric := range metrics {
+			if err := cw.Write(formatValues(rowValues(metric, hostname, labels))); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		if err := writeTabRow(tw, columns); err != nil {
+			return err
+		}
+		for _, metric := range metrics {
+			if err := writeTabRow(tw, formatValues(rowValues(metric, hostname, labels))); err != nil {
+				return err
+			}
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("unknown format %q, expected json, csv or table", format)
+}
+
+func writeTabRow(w io.Writer, values []string) error {
+	for i, v := range values {
+		sep := "\t"
+		if i == len(values)-1 {
+			sep = "\n"
+		}
+		if _, err := io.WriteString(w, v+sep); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// plainValue разыменовывает указатели, которые getValue отдает для части метрик
+func plainValue(v interface{}) interface{} {
+	switch p := v.(type) {
+	case *string:
+		return *p
+	case *float64:
+		return *p
+	}
+	return v
+}
+
+func formatValues(values []interface{}) []string {
+	formatted := make([]string, 0, len(values))
+	for _, v := range values {
+		switch p := plainValue(v).(type) {
+		case float64:
+			formatted = append(formatted, strconv.FormatFloat(p, 'f', -1, 64))
+		default:
+			formatted = append(formatted, fmt.Sprint(p))
+		}
+	}
+	return formatted
+}
@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestWriteMetrics_JSON(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, WriteMetrics(&buf, "json", &PgTableSizeFactory{}, "hostname", Labels{}, []PgMetric{getMockPgTableSize()}))
+
+	var rows []map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &rows))
+	assert.Len(t, rows, 1)
+	assert.Equal(t, "hostname", rows[0]["hostname"])
+	assert.Equal(t, "test", rows[0]["tablename"])
+	assert.Equal(t, float64(2), rows[0]["size"])
+}
+
+func TestWriteMetrics_CSV(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, WriteMetrics(&buf, "csv", &PgTableSizeFactory{}, "hostname", Labels{}, []PgMetric{getMockPgTableSize()}))
+
+	assert.Equal(t,
+		"hostname,datname,schemaname,tablename,n_live_tup,n_dead_tup,size,idx_size,size_growth,idx_size_growth,disk_capacity,collected_at,pg_role\n"+
+			"hostname,postgres,public,test,0,1,2,3,0,0,0,0,\n",
+		buf.String(),
+	)
+}
+
+func TestWriteMetrics_Table(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, WriteMetrics(&buf, "table", &PgStatStatementsFactory{}, "hostname", Labels{}, getDefaultMockSlice()))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 2)
+	assert.True(t, strings.HasPrefix(lines[0], "hostname"))
+	assert.Contains(t, lines[1], "select 1")
+}
+
+func TestWriteMetrics_UnknownFormat(t *testing.T) {
+	assert.Error(t, WriteMetrics(&bytes.Buffer{}, "xml", &PgTableSizeFactory{}, "hostname", Labels{}, nil))
+}
+
+func TestWriteMetrics_Labels(t *testing.T) {
+	var buf bytes.Buffer
+	labels := Labels{Cluster: "main", Environment: "prod"}.withInstance(&PgInstance{InRecovery: true})
+	assert.NoError(t, WriteMetrics(&buf, "csv", &PgTableSizeFactory{}, "hostname", labels, []PgMetric{getMockPgTableSize()}))
+
+	assert.Equal(t,
+		"hostname,datname,schemaname,tablename,n_live_tup,n_dead_tup,size,idx_size,size_growth,idx_size_growth,disk_capacity,collected_at,pg_role,cluster,environment\n"+
+			"hostname,postgres,public,test,0,1,2,3,0,0,0,0,standby,main,prod\n",
+		buf.String(),
+	)
+}
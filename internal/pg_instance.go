@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	eventInstanceChanged = "instance_changed"
+	eventRestart         = "restart"
+	eventPromoted        = "promoted"
+	eventDemoted         = "demoted"
+)
+
+// PgInstance - идентичность инстанса postgres, по ней проверяется что снапшот снят с того же сервера
+type PgInstance struct {
+	SystemIdentifier string `json:"system_identifier"`
+	StartTime        int64  `json:"start_time"`
+	InRecovery       bool   `json:"in_recovery"`
+	// ClusterName - GUC cluster_name, patroni выставляет его в имя кластера
+	ClusterName string `json:"cluster_name,omitempty"`
+	// ServerVersion - server_version_num, от него зависят имена колонок pg_stat_statements
+	ServerVersion int `json:"server_version,omitempty"`
+}
+
+func fetchInstance(ctx context.Context, db *sql.DB) (*PgInstance, error) {
+	instance := new(PgInstance)
+	err := db.QueryRowContext(ctx, `SELECT
+				system_identifier::text,
+				extract(epoch from pg_postmaster_start_time())::bigint,
+				pg_is_in_recovery(),
+				current_setting('cluster_name'),
+				current_setting('server_version_num')::int
+			FROM pg_control_system()`).Scan(
+		&instance.SystemIdentifier,
+		&instance.StartTime,
+		&instance.InRecovery,
+		&instance.ClusterName,
+		&instance.ServerVersion,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return instance, nil
+}
+
+// instanceName - host:port/database из DSN для логов
+func instanceName(config *pgx.ConnConfig) string {
+	return fmt.Sprintf("%s:%d/%s", config.Host, config.Port, config.Database)
+}
+
+// role - роль инстанса на момент fetchInstance: primary или standby
+func (i *PgInstance) role() string {
+	if i.InRecovery {
+		return "standby"
+	}
+	return "primary"
+}
+
+// serverVersion - server_version_num, 0 до первого подключения
+func (i *PgInstance) serverVersion() int {
+	if i == nil {
+		return 0
+	}
+	return i.ServerVersion
+}
+
+func (i *PgInstance) equal(other *PgInstance) bool {
+	if i == nil || other == nil {
+		return false
+	}
+	return i.SystemIdentifier == other.SystemIdentifier && i.StartTime == other.StartTime
+}
+
+// changeEvent - тип события, если между тиками за тем же DSN оказался другой, перезапущенный
+// или сменивший роль инстанс. Пустая строка - ничего не поменялось.
+func (i *PgInstance) changeEvent(old *PgInstance) string {
+	switch {
+	case old == nil:
+		return ""
+	case i.SystemIdentifier != old.SystemIdentifier:
+		return eventInstanceChanged
+	case i.StartTime != old.StartTime:
+		// в том числе patroni switchover на реплику с тем же system_identifier
+		return eventRestart
+	case old.InRecovery && !i.InRecovery:
+		return eventPromoted
+	case !old.InRecovery && i.InRecovery:
+		return eventDemoted
+	}
+	return ""
+}
+
+// maxPendingInstanceEvents - сколько неотправленных событий держим пока clickhouse недоступен, старые вытесняются
+const maxPendingInstanceEvents = 16
+
+// instanceEvent - смена инстанса, ждущая записи в clickhouse
+type instanceEvent struct {
+	event string
+	old   *PgInstance
+	new   *PgInstance
+}
+
+// flushInstanceEvents - пушит события по порядку, возвращает неотправленные начиная с первого упавшего
+func flushInstanceEvents(events []instanceEvent, push func(instanceEvent) error) ([]instanceEvent, error) {
+	for i, e := range events {
+		if err := push(e); err != nil {
+			return events[i:], fmt.Errorf("push instance event %s failed: %w", e.event, err)
+		}
+	}
+	return nil, nil
+}
+
+func instanceEventQuery(table string) string {
+	return `INSERT INTO ` + table + `(
+						hostname,
+						collector,
+						event,
+						old_system_identifier,
+						new_system_identifier,
+						old_start_time,
+						new_start_time,
+						old_in_recovery,
+						new_in_recovery) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+}
+
+func boolToUInt8(v bool) uint8 {
+	if v {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestPgInstance_changeEvent(t *testing.T) {
+	primary := &PgInstance{SystemIdentifier: "6848765366523682847", StartTime: 1600000000}
+
+	cases := []struct {
+		name     string
+		given    *PgInstance
+		expected string
+	}{
+		{"same", &PgInstance{SystemIdentifier: "6848765366523682847", StartTime: 1600000000}, ""},
+		{"other cluster", &PgInstance{SystemIdentifier: "6848765366523682000", StartTime: 1600000000}, eventInstanceChanged},
+		{"restart", &PgInstance{SystemIdentifier: "6848765366523682847", StartTime: 1600000100}, eventRestart},
+		{"demoted", &PgInstance{SystemIdentifier: "6848765366523682847", StartTime: 1600000000, InRecovery: true}, eventDemoted},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.expected, c.given.changeEvent(primary), c.name)
+	}
+
+	standby := &PgInstance{SystemIdentifier: "6848765366523682847", StartTime: 1600000000, InRecovery: true}
+	assert.Equal(t, eventPromoted, primary.changeEvent(standby), "promoted")
+	assert.Equal(t, "", primary.changeEvent(nil), "no previous instance")
+}
+
+func TestPgInstance_equal(t *testing.T) {
+	given := &PgInstance{SystemIdentifier: "6848765366523682847", StartTime: 1600000000}
+	assert.True(t, given.equal(&PgInstance{SystemIdentifier: "6848765366523682847", StartTime: 1600000000, InRecovery: true}))
+	assert.False(t, given.equal(&PgInstance{SystemIdentifier: "6848765366523682847", StartTime: 1600000001}))
+	assert.False(t, given.equal(nil))
+}
+
+func TestFlushInstanceEvents(t *testing.T) {
+	old := &PgInstance{SystemIdentifier: "6848765366523682847", StartTime: 1600000000}
+	restarted := &PgInstance{SystemIdentifier: "6848765366523682847", StartTime: 1600000100}
+	events := []instanceEvent{
+		{event: eventRestart, old: old, new: restarted},
+		{event: eventDemoted, old: restarted, new: &PgInstance{SystemIdentifier: "6848765366523682847", StartTime: 1600000100, InRecovery: true}},
+	}
+
+	var pushed []string
+	failing := func(e instanceEvent) error {
+		if e.event == eventDemoted {
+			return errors.New("clickhouse is down")
+		}
+		pushed = append(pushed, e.event)
+		return nil
+	}
+	pending, err := flushInstanceEvents(events, failing)
+	assert.Error(t, err)
+	assert.Equal(t, []string{eventRestart}, pushed)
+	assert.Equal(t, 1, len(pending))
+	assert.Equal(t, eventDemoted, pending[0].event)
+
+	pending, err = flushInstanceEvents(pending, func(e instanceEvent) error {
+		pushed = append(pushed, e.event)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(pending))
+	assert.Equal(t, []string{eventRestart, eventDemoted}, pushed)
+}
@@ -20,6 +20,14 @@ func (s *SomePgMetric) getValue(hostname string) []interface{} {
 	return []interface{}{1, 2}
 }
 
+func (s *SomePgMetric) fields() []interface{} {
+	return []interface{}{}
+}
+
+func (s *SomePgMetric) appendTo(strs []string, floats []float64) ([]string, []float64) {
+	return strs, floats
+}
+
 func assertPanic(t *testing.T, f func(), errorText string) {
 	defer func() {
 		if r := recover(); r == nil {
@@ -0,0 +1,186 @@
+package internal
+
+import (
+	"fmt"
+)
+
+// PgStatMetrics - снапшот метрик в колоночном виде, version - время сбора.
+// Строковые поля метрик интернированы в pool, в строке снапшота лежит только их id,
+// числовые поля лежат подряд: поле j строки i - floats[i*floatFields+j].
+// Вместо map по hash ключа - хэш-таблица с открытой адресацией из номеров строк.
+// Указатели для GC есть только в pool строк без дубликатов, а не в каждой строке снапшота, см. BenchmarkPgStatMetrics_*
+type PgStatMetrics struct {
+	version int64
+
+	stringFields int
+	floatFields  int
+	strs         []uint32
+	floats       []float64
+	hashes       []uint32
+	// index - номер строки + 1 в слоте hash & (len-1) или дальше по кругу, 0 - пустой слот. Строится в seal
+	index []int32
+	pool  stringPool
+	// rowStrs - строковые поля добавляемой строки до интернирования, переиспользуется между строками.
+	// После seal не нужен
+	rowStrs []string
+}
+
+// internMaxLen - строки длиннее хранятся в pool без поиска дубликатов
+const internMaxLen = 128
+
+// stringPool - одинаковые datname, schemaname, username и имена таблиц хранятся один раз, длинные тексты запросов - как есть.
+// ids нужен, только пока снапшот собирается, seal его отпускает
+type stringPool struct {
+	values []string
+	ids    map[string]uint32
+}
+
+func (p *stringPool) intern(s string) uint32 {
+	if len(s) > internMaxLen {
+		// длинные строки - тексты запросов, почти все уникальны, хэшировать их на каждой строке дороже экономии
+		p.values = append(p.values, s)
+		return uint32(len(p.values) - 1)
+	}
+	if id, ok := p.ids[s]; ok {
+		return id
+	}
+	if p.ids == nil {
+		p.ids = make(map[string]uint32)
+	}
+	id := uint32(len(p.values))
+	p.values = append(p.values, s)
+	p.ids[s] = id
+	return id
+}
+
+// newPgStatMetrics - пустой снапшот, capacity - ожидаемое количество строк
+func newPgStatMetrics(capacity int) *PgStatMetrics {
+	return &PgStatMetrics{
+		hashes: make([]uint32, 0, capacity),
+		// строк в pool обычно порядка строк снапшота: имя таблицы или текст запроса
+		pool: stringPool{values: make([]string, 0, capacity), ids: make(map[string]uint32, capacity)},
+	}
+}
+
+// append раскладывает метрику по колонкам через appendTo, раскладка полей берется из fields() первой метрики.
+// После seal добавлять строки нельзя
+func (m *PgStatMetrics) append(metric PgMetric) {
+	if m.rowStrs == nil {
+		m.stringFields, m.floatFields = 0, 0
+		for _, f := range metric.fields() {
+			switch f.(type) {
+			case *string:
+				m.stringFields++
+			case *float64:
+				m.floatFields++
+			default:
+				panic(fmt.Sprintf("append: unsupported field type %T", f))
+			}
+		}
+		m.rowStrs = make([]string, 0, m.stringFields)
+		if rows := cap(m.hashes); rows > 0 {
+			m.strs = make([]uint32, 0, rows*m.stringFields)
+			m.floats = make([]float64, 0, rows*m.floatFields)
+		}
+	}
+	m.rowStrs, m.floats = metric.appendTo(m.rowStrs[:0], m.floats)
+	for _, s := range m.rowStrs {
+		m.strs = append(m.strs, m.pool.intern(s))
+	}
+	m.hashes = append(m.hashes, metric.getHash())
+}
+
+// seal строит индекс по hash и отпускает map интернирования, после него работает lookup.
+// Таблица заполнена не больше чем наполовину, при коллизии hash в слоте остается последняя строка
+func (m *PgStatMetrics) seal() {
+	m.pool.ids = nil
+	m.rowStrs = nil
+	if len(m.hashes) == 0 {
+		m.index = nil
+		return
+	}
+	size := 1
+	for size < 2*len(m.hashes) {
+		size <<= 1
+	}
+	m.index = make([]int32, size)
+	mask := uint32(size - 1)
+	for i, hash := range m.hashes {
+		slot := hash & mask
+		for m.index[slot] != 0 && m.hashes[m.index[slot]-1] != hash {
+			slot = (slot + 1) & mask
+		}
+		m.index[slot] = int32(i + 1)
+	}
+}
+
+func (m *PgStatMetrics) len() int {
+	return len(m.hashes)
+}
+
+func (m *PgStatMetrics) hash(i int) uint32 {
+	return m.hashes[i]
+}
+
+// lookup - строка с таким hash ключа. При коллизии, как и раньше в map, побеждает последняя строка
+func (m *PgStatMetrics) lookup(hash uint32) (int, bool) {
+	if len(m.index) == 0 {
+		return 0, false
+	}
+	mask := uint32(len(m.index) - 1)
+	for slot := hash & mask; m.index[slot] != 0; slot = (slot + 1) & mask {
+		if row := int(m.index[slot] - 1); m.hashes[row] == hash {
+			return row, true
+		}
+	}
+	return 0, false
+}
+
+// load записывает строку i в поля метрики. fields - результат metric.fields(),
+// его можно получить один раз и переиспользовать метрику для всех строк без аллокаций
+func (m *PgStatMetrics) load(i int, fields []interface{}) {
+	s, f := i*m.stringFields, i*m.floatFields
+	for _, field := range fields {
+		switch v := field.(type) {
+		case *string:
+			*v = m.pool.values[m.strs[s]]
+			s++
+		case *float64:
+			*v = m.floats[f]
+			f++
+		}
+	}
+}
+
+// withRest - снапшот из строк m и тех строк old, ключей которых в m нет. База после оборванного скана:
+// у дочитанных строк она новая, у остальных прежняя
+func (m *PgStatMetrics) withRest(old *PgStatMetrics, cf CollectorFactory) *PgStatMetrics {
+	m.seal()
+	result := newPgStatMetrics(m.len() + old.len())
+	metric := cf.emptyMetric()
+	fields := metric.fields()
+	for i := 0; i < m.len(); i++ {
+		m.load(i, fields)
+		result.append(metric)
+	}
+	for i := 0; i < old.len(); i++ {
+		if _, ok := m.lookup(old.hash(i)); !ok {
+			old.load(i, fields)
+			result.append(metric)
+		}
+	}
+	result.seal()
+	result.version = m.version
+	return result
+}
+
+// metrics - все строки снапшота отдельными метриками, для вывода и тестов
+func (m *PgStatMetrics) metrics(cf CollectorFactory) []PgMetric {
+	metrics := make([]PgMetric, 0, m.len())
+	for i := 0; i < m.len(); i++ {
+		metric := cf.emptyMetric()
+		m.load(i, metric.fields())
+		metrics = append(metrics, metric)
+	}
+	return metrics
+}
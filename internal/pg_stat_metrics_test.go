@@ -0,0 +1,270 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// snapshotOf - снапшот из готовых метрик, как его собирает Collect
+func snapshotOf(version int64, rows ...PgMetric) *PgStatMetrics {
+	snapshot := newPgStatMetrics(len(rows))
+	for _, row := range rows {
+		snapshot.append(row)
+	}
+	snapshot.seal()
+	snapshot.version = version
+	return snapshot
+}
+
+func TestPgStatMetrics_AppendLoad(t *testing.T) {
+	first := getDefaultMock()
+	second := getDefaultMock().(*PgStatStatement)
+	second.queryid = 123
+	second.calls = 42
+
+	snapshot := snapshotOf(1, first, second)
+	assert.Equal(t, 2, snapshot.len())
+	assert.Equal(t, []PgMetric{first, second}, snapshot.metrics(&PgStatStatementsFactory{}))
+	assert.Equal(t, []string{"postgres", "select 1"}, snapshot.pool.values, "strings should be interned")
+	assert.Nil(t, snapshot.pool.ids, "intern map should be released by seal")
+
+	metric := new(PgStatStatement)
+	snapshot.load(1, metric.fields())
+	assert.Equal(t, second, metric)
+}
+
+func TestPgMetric_appendTo(t *testing.T) {
+	metrics := []PgMetric{getDefaultMock(), getMockPgStatio(), getMockPgTableSize(), &SomePgMetric{}}
+	for _, metric := range metrics {
+		var expectedStrs []string
+		var expectedFloats []float64
+		for _, f := range metric.fields() {
+			switch v := f.(type) {
+			case *string:
+				expectedStrs = append(expectedStrs, *v)
+			case *float64:
+				expectedFloats = append(expectedFloats, *v)
+			}
+		}
+		strs, floats := metric.appendTo([]string{"prefix"}, nil)
+		assert.Equal(t, append([]string{"prefix"}, expectedStrs...), strs, "%T: strings in the order of fields()", metric)
+		assert.Equal(t, expectedFloats, floats, "%T: floats in the order of fields()", metric)
+	}
+}
+
+func TestPgStatMetrics_Lookup(t *testing.T) {
+	first := getMockPgTableSize()
+	second := getMockPgTableSize().(*PgTableSize)
+	second.tablename = "other"
+	collision := getMockPgTableSize().(*PgTableSize)
+	collision.size = 100
+
+	snapshot := snapshotOf(1, first, second, collision)
+	i, ok := snapshot.lookup(second.getHash())
+	assert.True(t, ok)
+	assert.Equal(t, 1, i)
+
+	i, ok = snapshot.lookup(first.getHash())
+	assert.True(t, ok)
+	assert.Equal(t, 2, i, "the last row wins on hash collision")
+
+	_, ok = snapshot.lookup(getHash("missing"))
+	assert.False(t, ok)
+
+	_, ok = snapshotOf(1).lookup(first.getHash())
+	assert.False(t, ok, "empty snapshot")
+}
+
+func TestPgStatMetrics_Merge(t *testing.T) {
+	old := getDefaultMock()
+	unchanged := getDefaultMock().(*PgStatStatement)
+	unchanged.queryid = 1
+	added := getDefaultMock().(*PgStatStatement)
+	added.queryid = 2
+	current := getDefaultMock().(*PgStatStatement)
+	current.calls, current.total_time = 3, 10
+
+	now := time.Now().Unix()
+	sc := &StatsCollector{cf: &PgStatStatementsFactory{}, ttl: 60, snapshot: snapshotOf(now-30, old, unchanged)}
+	actual, err := sc.Merge(context.Background(), snapshotOf(now, current, unchanged, added))
+	assert.NoError(t, err)
+
+	expected := getDefaultMock().(*PgStatStatement)
+	expected.calls, expected.total_time, expected.mean_time = 2, 8, 4
+	expected.rows, expected.shared_blks_hit, expected.shared_blks_read, expected.shared_blks_dirtied = 0, 0, 0, 0
+	expected.shared_blks_written, expected.local_blks_hit, expected.local_blks_read, expected.local_blks_dirtied = 0, 0, 0, 0
+	expected.local_blks_written, expected.temp_blks_read, expected.temp_blks_written = 0, 0, 0
+	expected.blk_read_time, expected.blk_write_time = 0, 0
+	assert.Equal(t, []PgMetric{expected, added}, actual, "unchanged statement is skipped, new one is pushed as is")
+	assert.Equal(t, now, sc.snapshot.version)
+}
+
+// legacySnapshot - раскладка снапшота до PgStatMetrics: метрика на строку и map по hash, для сравнения в бенчмарках
+type legacySnapshot struct {
+	rows     []PgMetric
+	keysHash map[uint32]int
+}
+
+func newLegacySnapshot(rows []PgMetric) *legacySnapshot {
+	keysHash := make(map[uint32]int)
+	for i, metric := range rows {
+		keysHash[metric.getHash()] = i
+	}
+	return &legacySnapshot{rows: rows, keysHash: keysHash}
+}
+
+func (s *legacySnapshot) merge(old *legacySnapshot) []PgMetric {
+	mergedRows := make([]PgMetric, 0, len(s.rows))
+	for k, mIdx := range s.keysHash {
+		if sIdx, ok := old.keysHash[k]; ok {
+			if s.rows[mIdx].isSkippable(old.rows[sIdx]) {
+				continue
+			}
+			mergedRows = append(mergedRows, s.rows[mIdx].delta(old.rows[sIdx]))
+		} else {
+			mergedRows = append(mergedRows, s.rows[mIdx])
+		}
+	}
+	return mergedRows
+}
+
+// benchTables - n таблиц в 100 схемах, как их сканирует database/sql: у каждой строки свои копии строк.
+// На тике tick счетчики меняются у каждой десятой таблицы
+func benchTables(n int, tick int) []PgMetric {
+	rows := make([]PgMetric, 0, n)
+	for i := 0; i < n; i++ {
+		changed := float64(0)
+		if i%10 == 0 {
+			changed = float64(tick)
+		}
+		rows = append(rows, &PgStatioTable{
+			datname:        strings.Clone("postgres"),
+			schemaname:     fmt.Sprintf("schema_%d", i%100),
+			tablename:      fmt.Sprintf("table_%d", i),
+			heap_blks_read: float64(i) + changed,
+			heap_blks_hit:  float64(i) * 10,
+			idx_blks_hit:   float64(i) * 5,
+			seq_scan:       float64(i) + changed,
+			seq_tup_read:   float64(i) * 100,
+			n_tup_ins:      float64(i) + changed,
+		})
+	}
+	return rows
+}
+
+// benchStatements - n запросов по ~500 символов от 10 пользователей, на тике tick вызывается каждый второй
+func benchStatements(n int, tick int) []PgMetric {
+	rows := make([]PgMetric, 0, n)
+	for i := 0; i < n; i++ {
+		changed := float64(0)
+		if i%2 == 0 {
+			changed = float64(tick)
+		}
+		rows = append(rows, &PgStatStatement{
+			queryid:         float64(i),
+			datname:         strings.Clone("postgres"),
+			username:        fmt.Sprintf("user_%d", i%10),
+			query:           fmt.Sprintf("SELECT %d FROM t WHERE id = $1", i) + strings.Repeat(" AND x = $2", 45),
+			calls:           float64(i) + changed,
+			total_time:      float64(i)*3 + changed,
+			rows:            float64(i) + changed,
+			shared_blks_hit: float64(i) * 7,
+		})
+	}
+	return rows
+}
+
+var benchSnapshots = []struct {
+	name string
+	cf   CollectorFactory
+	gen  func(n int, tick int) []PgMetric
+	n    int
+}{
+	{"tables_100k", &PgStatioTableFactory{}, benchTables, 100000},
+	{"statements_10k", &PgStatStatementsFactory{}, benchStatements, 10000},
+}
+
+// retainedBytes - сколько heap остается занято результатом build после сборки мусора
+func retainedBytes(build func() interface{}) float64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	result := build()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(result)
+	return float64(after.HeapAlloc) - float64(before.HeapAlloc)
+}
+
+// BenchmarkPgStatMetrics_Build - снапшот из только что отсканированных строк, как в Collect.
+// retained-B - сколько памяти снапшот держит до следующего тика
+func BenchmarkPgStatMetrics_Build(b *testing.B) {
+	for _, bs := range benchSnapshots {
+		b.Run(bs.name+"/legacy", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				newLegacySnapshot(bs.gen(bs.n, 0))
+			}
+			b.ReportMetric(retainedBytes(func() interface{} { return newLegacySnapshot(bs.gen(bs.n, 0)) }), "retained-B")
+		})
+		b.Run(bs.name+"/compact", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				snapshotOf(0, bs.gen(bs.n, 0)...)
+			}
+			b.ReportMetric(retainedBytes(func() interface{} { return snapshotOf(0, bs.gen(bs.n, 0)...) }), "retained-B")
+		})
+	}
+}
+
+func BenchmarkPgStatMetrics_Merge(b *testing.B) {
+	for _, bs := range benchSnapshots {
+		b.Run(bs.name+"/legacy", func(b *testing.B) {
+			old, current := newLegacySnapshot(bs.gen(bs.n, 0)), newLegacySnapshot(bs.gen(bs.n, 1))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				current.merge(old)
+			}
+		})
+		b.Run(bs.name+"/compact", func(b *testing.B) {
+			old, current := snapshotOf(0, bs.gen(bs.n, 0)...), snapshotOf(1, bs.gen(bs.n, 1)...)
+			sc := &StatsCollector{cf: bs.cf, ttl: 60}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				sc.snapshot = old
+				if _, err := sc.Merge(context.Background(), current); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkPgStatMetrics_GC - цена полного GC, пока снапшот лежит в памяти между тиками
+func BenchmarkPgStatMetrics_GC(b *testing.B) {
+	for _, bs := range benchSnapshots {
+		b.Run(bs.name+"/legacy", func(b *testing.B) {
+			snapshot := newLegacySnapshot(bs.gen(bs.n, 0))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				runtime.GC()
+			}
+			runtime.KeepAlive(snapshot)
+		})
+		b.Run(bs.name+"/compact", func(b *testing.B) {
+			snapshot := snapshotOf(0, bs.gen(bs.n, 0)...)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				runtime.GC()
+			}
+			runtime.KeepAlive(snapshot)
+		})
+	}
+}
@@ -1,8 +1,10 @@
 package internal
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"math"
 )
 
 type PgStatStatementsFactory struct{}
@@ -14,6 +16,10 @@ type PgStatStatement struct {
 	query               string
 	calls               float64
 	total_time          float64
+	min_time            float64
+	max_time            float64
+	mean_time           float64
+	stddev_time         float64
 	rows                float64
 	shared_blks_hit     float64
 	shared_blks_read    float64
@@ -33,7 +39,16 @@ func (f *PgStatStatementsFactory) Name() string {
 	return "PgStatStatements"
 }
 
-func (f *PgStatStatementsFactory) CollectQuery() string {
+// execTimeColumn - в PostgreSQL 13 колонки времени выполнения переименованы в *_exec_time,
+// а время планирования ушло в отдельные *_plan_time, которые не собираются
+func execTimeColumn(name string, serverVersion int) string {
+	if serverVersion >= 130000 {
+		return name + "_exec_time"
+	}
+	return name + "_time"
+}
+
+func (f *PgStatStatementsFactory) CollectQuery(serverVersion int) string {
 	//main query to get metrics
 	return `SELECT
 				queryid,
@@ -41,7 +56,11 @@ func (f *PgStatStatementsFactory) CollectQuery() string {
 				pg_catalog.pg_get_userbyid(userid) username,
 				left(query, 3000) as query, 
 				calls as calls, 
-				total_time as total_time, 
+				` + execTimeColumn("total", serverVersion) + ` as total_time, 
+				` + execTimeColumn("min", serverVersion) + ` as min_time,
+				` + execTimeColumn("max", serverVersion) + ` as max_time,
+				` + execTimeColumn("mean", serverVersion) + ` as mean_time,
+				` + execTimeColumn("stddev", serverVersion) + ` as stddev_time,
 				rows as rows,
 				shared_blks_hit,
 				shared_blks_read,
@@ -60,33 +79,58 @@ func (f *PgStatStatementsFactory) CollectQuery() string {
 			ORDER BY queryid, datname, username, query`
 }
 
-func (f *PgStatStatementsFactory) PushQuery() string {
-	//query to store in clickhouse populated data with hostname
-	return `INSERT INTO pg.pg_stat_statements_buffer(
-					hostname,
-					datname,
-					username,
-					query,
-					calls,
-					total_time,
-					rows,
-					shared_blks_hit,
-					shared_blks_read,
-					shared_blks_dirtied,
-					shared_blks_written,
-					local_blks_hit,
-					local_blks_read,
-					local_blks_dirtied,
-					local_blks_written,
-					temp_blks_read,
-					temp_blks_written,
-					blk_read_time,
-					blk_write_time) VALUES (
-						?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?
-					)`
-}
-
-func (f *PgStatStatementsFactory) NewMetric(rows *sql.Rows) (PgMetric, error) {
+func (f *PgStatStatementsFactory) TableName() string {
+	return "pg_stat_statements"
+}
+
+func (f *PgStatStatementsFactory) prerequisites() []prerequisite {
+	return []prerequisite{
+		roleMember("pg_read_all_stats", "without it queryid and query of other users' statements are NULL"),
+		extensionInstalled("pg_stat_statements"),
+		preloadLibrariesReadable,
+		preloadLibrary("pg_stat_statements"),
+		viewReadable("pg_stat_statements"),
+	}
+}
+
+func (f *PgStatStatementsFactory) PushColumns() []string {
+	return []string{
+		"hostname",
+		"datname",
+		"username",
+		"query",
+		"calls",
+		"total_time",
+		"min_time",
+		"max_time",
+		"mean_time",
+		"stddev_time",
+		"rows",
+		"shared_blks_hit",
+		"shared_blks_read",
+		"shared_blks_dirtied",
+		"shared_blks_written",
+		"local_blks_hit",
+		"local_blks_read",
+		"local_blks_dirtied",
+		"local_blks_written",
+		"temp_blks_read",
+		"temp_blks_written",
+		"blk_read_time",
+		"blk_write_time",
+	}
+}
+
+// gaugeColumns - все колонки накопленные счетчики
+func (f *PgStatStatementsFactory) gaugeColumns() []string {
+	return nil
+}
+
+func (f *PgStatStatementsFactory) emptyMetric() PgMetric {
+	return new(PgStatStatement)
+}
+
+func (f *PgStatStatementsFactory) NewMetric(ctx context.Context, rows *sql.Rows) (PgMetric, error) {
 	metric := new(PgStatStatement)
 	err := rows.Scan(
 		&metric.queryid,
@@ -95,6 +139,10 @@ func (f *PgStatStatementsFactory) NewMetric(rows *sql.Rows) (PgMetric, error) {
 		&metric.query,
 		&metric.calls,
 		&metric.total_time,
+		&metric.min_time,
+		&metric.max_time,
+		&metric.mean_time,
+		&metric.stddev_time,
 		&metric.rows,
 		&metric.shared_blks_hit,
 		&metric.shared_blks_read,
@@ -140,6 +188,10 @@ func (pss *PgStatStatement) delta(old PgMetric) PgMetric {
 			query:               pss.query,
 			calls:               pss.calls,
 			total_time:          pss.total_time,
+			min_time:            pss.min_time,
+			max_time:            pss.max_time,
+			mean_time:           pss.mean_time,
+			stddev_time:         pss.stddev_time,
 			rows:                pss.rows,
 			shared_blks_hit:     pss.shared_blks_hit,
 			shared_blks_read:    pss.shared_blks_read,
@@ -155,6 +207,7 @@ func (pss *PgStatStatement) delta(old PgMetric) PgMetric {
 			blk_write_time:      pss.blk_write_time,
 		}
 	} else {
+		mean, stddev := intervalExecTime(pss, v)
 		return &PgStatStatement{
 			queryid:             pss.queryid,
 			datname:             pss.datname,
@@ -162,6 +215,10 @@ func (pss *PgStatStatement) delta(old PgMetric) PgMetric {
 			query:               pss.query,
 			calls:               pss.calls - v.calls,
 			total_time:          pss.total_time - v.total_time,
+			min_time:            pss.min_time,
+			max_time:            pss.max_time,
+			mean_time:           mean,
+			stddev_time:         stddev,
 			rows:                pss.rows - v.rows,
 			shared_blks_hit:     pss.shared_blks_hit - v.shared_blks_hit,
 			shared_blks_read:    pss.shared_blks_read - v.shared_blks_read,
@@ -179,6 +236,24 @@ func (pss *PgStatStatement) delta(old PgMetric) PgMetric {
 	}
 }
 
+// intervalExecTime - среднее и stddev времени выполнения за интервал между снапшотами old и pss.
+// pg_stat_statements отдает их с момента reset-а, но из stddev (по генеральной совокупности) и mean восстанавливается
+// сумма квадратов calls * (stddev^2 + mean^2), и ее дельта дает дисперсию интервала. min и max так не восстановить,
+// они отправляются как есть, с момента reset-а
+func intervalExecTime(pss *PgStatStatement, old *PgStatStatement) (float64, float64) {
+	calls := pss.calls - old.calls
+	if calls <= 0 {
+		return 0, 0
+	}
+	sumSq := func(m *PgStatStatement) float64 {
+		return m.calls * (m.stddev_time*m.stddev_time + m.mean_time*m.mean_time)
+	}
+	mean := (pss.total_time - old.total_time) / calls
+	// на долгоживущих запросах вычитание больших сумм теряет точность, дисперсия может уйти чуть ниже нуля
+	variance := math.Max((sumSq(pss)-sumSq(old))/calls-mean*mean, 0)
+	return mean, math.Sqrt(variance)
+}
+
 /*
 	как здесь написано, допускается использовать queryid в комбо с dbid, userid для идентификации запросов
 	https://www.postgresql.org/docs/current/pgstatstatements.html
@@ -195,6 +270,10 @@ func (pss *PgStatStatement) getValue(hostname string) []interface{} {
 		pss.query,
 		pss.calls,
 		pss.total_time,
+		pss.min_time,
+		pss.max_time,
+		pss.mean_time,
+		pss.stddev_time,
 		pss.rows,
 		pss.shared_blks_hit,
 		pss.shared_blks_read,
@@ -210,3 +289,58 @@ func (pss *PgStatStatement) getValue(hostname string) []interface{} {
 		pss.blk_write_time,
 	}
 }
+
+func (pss *PgStatStatement) fields() []interface{} {
+	return []interface{}{
+		&pss.queryid,
+		&pss.datname,
+		&pss.username,
+		&pss.query,
+		&pss.calls,
+		&pss.total_time,
+		&pss.min_time,
+		&pss.max_time,
+		&pss.mean_time,
+		&pss.stddev_time,
+		&pss.rows,
+		&pss.shared_blks_hit,
+		&pss.shared_blks_read,
+		&pss.shared_blks_dirtied,
+		&pss.shared_blks_written,
+		&pss.local_blks_hit,
+		&pss.local_blks_read,
+		&pss.local_blks_dirtied,
+		&pss.local_blks_written,
+		&pss.temp_blks_read,
+		&pss.temp_blks_written,
+		&pss.blk_read_time,
+		&pss.blk_write_time,
+	}
+}
+
+func (pss *PgStatStatement) appendTo(strs []string, floats []float64) ([]string, []float64) {
+	strs = append(strs, pss.datname, pss.username, pss.query)
+	floats = append(floats,
+		pss.queryid,
+		pss.calls,
+		pss.total_time,
+		pss.min_time,
+		pss.max_time,
+		pss.mean_time,
+		pss.stddev_time,
+		pss.rows,
+		pss.shared_blks_hit,
+		pss.shared_blks_read,
+		pss.shared_blks_dirtied,
+		pss.shared_blks_written,
+		pss.local_blks_hit,
+		pss.local_blks_read,
+		pss.local_blks_dirtied,
+		pss.local_blks_written,
+		pss.temp_blks_read,
+		pss.temp_blks_written,
+		pss.blk_read_time,
+		pss.blk_write_time,
+	)
+	return strs, floats
+}
@@ -2,6 +2,7 @@ package internal
 
 import (
 	"github.com/stretchr/testify/assert"
+	"strings"
 	"testing"
 )
 
@@ -19,3 +20,28 @@ func TestPgStatsStatement_Name(t *testing.T) {
 	given := &PgStatStatementsFactory{}
 	assert.Equal(t, "PgStatStatements", given.Name())
 }
+
+func TestPgStatsStatement_CollectQuery(t *testing.T) {
+	given := &PgStatStatementsFactory{}
+	assert.True(t, strings.Contains(given.CollectQuery(120000), "stddev_time as stddev_time"))
+	assert.False(t, strings.Contains(given.CollectQuery(120000), "_exec_time"))
+	assert.True(t, strings.Contains(given.CollectQuery(130000), "total_exec_time as total_time"))
+	assert.True(t, strings.Contains(given.CollectQuery(160000), "stddev_exec_time as stddev_time"))
+	assert.Equal(t, given.CollectQuery(0), given.CollectQuery(110000), "unknown version - names before 13")
+}
+
+func TestPgStatsStatement_IntervalExecTime(t *testing.T) {
+	// 1 и 3 ms до старого снапшота, 5 и 7 ms между снапшотами
+	old := &PgStatStatement{calls: 2, total_time: 4, min_time: 1, max_time: 3, mean_time: 2, stddev_time: 1}
+	current := &PgStatStatement{calls: 4, total_time: 16, min_time: 1, max_time: 7, mean_time: 4, stddev_time: 2.23606797749979}
+
+	delta := current.delta(old).(*PgStatStatement)
+	assert.InDelta(t, 6, delta.mean_time, 1e-9)
+	assert.InDelta(t, 1, delta.stddev_time, 1e-9)
+	assert.Equal(t, float64(1), delta.min_time, "min and max are since reset")
+	assert.Equal(t, float64(7), delta.max_time)
+
+	mean, stddev := intervalExecTime(current, current)
+	assert.Equal(t, float64(0), mean, "no calls")
+	assert.Equal(t, float64(0), stddev)
+}
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 )
@@ -37,7 +38,7 @@ func (f *PgStatioTableFactory) Name() string {
 	return "PgStatioTable"
 }
 
-func (f *PgStatioTableFactory) CollectQuery() string {
+func (f *PgStatioTableFactory) CollectQuery(serverVersion int) string {
 	//main query to get metrics
 	return `SELECT
 				current_database() datname,
@@ -68,40 +69,56 @@ func (f *PgStatioTableFactory) CollectQuery() string {
 			WHERE a.schemaname not in ('pg_toast', 'information_schema')`
 }
 
-func (f *PgStatioTableFactory) PushQuery() string {
-	//query to store in clickhouse populated data with hostname
-	return `INSERT INTO pg.pg_statio_tables_buffer(
-						hostname,
-						datname,
-						schemaname,
-						tablename,
-						heap_blks_read,
-						heap_blks_hit,
-						idx_blks_read,
-						idx_blks_hit,
-						toast_blks_read,
-						toast_blks_hit,
-						tidx_blks_read,
-						tidx_blks_hit,
-						seq_scan,
-						seq_tup_read,
-						idx_scan,
-						idx_tup_fetch,
-						n_tup_ins,
-						n_tup_upd,
-						n_tup_del,
-						n_tup_hot_upd,
-						vacuum_count,
-						autovacuum_count,
-						analyze_count,
-						autoanalyze_count) VALUES (
-						?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 
-					    ?, ?, ?, ?, ?, ?, ?, ?, ?, ?,
-						?, ?, ?, ?
-					)`
+func (f *PgStatioTableFactory) TableName() string {
+	return "pg_statio_tables"
 }
 
-func (f *PgStatioTableFactory) NewMetric(rows *sql.Rows) (PgMetric, error) {
+func (f *PgStatioTableFactory) prerequisites() []prerequisite {
+	return []prerequisite{
+		viewReadable("pg_statio_user_tables"),
+		viewReadable("pg_stat_user_tables"),
+	}
+}
+
+func (f *PgStatioTableFactory) PushColumns() []string {
+	return []string{
+		"hostname",
+		"datname",
+		"schemaname",
+		"tablename",
+		"heap_blks_read",
+		"heap_blks_hit",
+		"idx_blks_read",
+		"idx_blks_hit",
+		"toast_blks_read",
+		"toast_blks_hit",
+		"tidx_blks_read",
+		"tidx_blks_hit",
+		"seq_scan",
+		"seq_tup_read",
+		"idx_scan",
+		"idx_tup_fetch",
+		"n_tup_ins",
+		"n_tup_upd",
+		"n_tup_del",
+		"n_tup_hot_upd",
+		"vacuum_count",
+		"autovacuum_count",
+		"analyze_count",
+		"autoanalyze_count",
+	}
+}
+
+// gaugeColumns - все колонки накопленные счетчики
+func (f *PgStatioTableFactory) gaugeColumns() []string {
+	return nil
+}
+
+func (f *PgStatioTableFactory) emptyMetric() PgMetric {
+	return new(PgStatioTable)
+}
+
+func (f *PgStatioTableFactory) NewMetric(ctx context.Context, rows *sql.Rows) (PgMetric, error) {
 	metric := new(PgStatioTable)
 
 	var idx_blks_read,
@@ -280,3 +297,58 @@ func (p *PgStatioTable) getValue(hostname string) []interface{} {
 		&p.autoanalyze_count,
 	}
 }
+
+func (p *PgStatioTable) fields() []interface{} {
+	return []interface{}{
+		&p.datname,
+		&p.schemaname,
+		&p.tablename,
+		&p.heap_blks_read,
+		&p.heap_blks_hit,
+		&p.idx_blks_read,
+		&p.idx_blks_hit,
+		&p.toast_blks_read,
+		&p.toast_blks_hit,
+		&p.tidx_blks_read,
+		&p.tidx_blks_hit,
+		&p.seq_scan,
+		&p.seq_tup_read,
+		&p.idx_scan,
+		&p.idx_tup_fetch,
+		&p.n_tup_ins,
+		&p.n_tup_upd,
+		&p.n_tup_del,
+		&p.n_tup_hot_upd,
+		&p.vacuum_count,
+		&p.autovacuum_count,
+		&p.analyze_count,
+		&p.autoanalyze_count,
+	}
+}
+
+func (p *PgStatioTable) appendTo(strs []string, floats []float64) ([]string, []float64) {
+	strs = append(strs, p.datname, p.schemaname, p.tablename)
+	floats = append(floats,
+		p.heap_blks_read,
+		p.heap_blks_hit,
+		p.idx_blks_read,
+		p.idx_blks_hit,
+		p.toast_blks_read,
+		p.toast_blks_hit,
+		p.tidx_blks_read,
+		p.tidx_blks_hit,
+		p.seq_scan,
+		p.seq_tup_read,
+		p.idx_scan,
+		p.idx_tup_fetch,
+		p.n_tup_ins,
+		p.n_tup_upd,
+		p.n_tup_del,
+		p.n_tup_hot_upd,
+		p.vacuum_count,
+		p.autovacuum_count,
+		p.analyze_count,
+		p.autoanalyze_count,
+	)
+	return strs, floats
+}
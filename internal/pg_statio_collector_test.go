@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"context"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -123,10 +124,10 @@ func TestPgStatioTable_Delta_AfterReset(t *testing.T) {
 }
 
 func TestStatsCollector_Push_PgStatioTable(t *testing.T) {
-	sc, err := NewStatsCollector(&PgStatioTableFactory{}, "hostname", postgresDockerDsn, clickhouseDockerDsn, 60)
+	sc, err := NewStatsCollector(context.Background(), &PgStatioTableFactory{}, "hostname", postgresDockerDsn, clickhouseDockerDsn, 60, CollectorOptions{})
 	assert.Empty(t, err, "error init collector")
 
 	given := getMockPgStatioSlice()
 
-	assert.NoError(t, sc.Push(given), "error during push metrics")
+	assert.NoError(t, sc.Push(context.Background(), given, ""), "error during push metrics")
 }
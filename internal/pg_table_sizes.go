@@ -1,11 +1,15 @@
 package internal
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 )
 
-type PgTableSizeFactory struct{}
+// PgTableSizeFactory - DiskCapacity пишется в каждую строку для прогноза заполнения диска в clickhouse, 0 - не задана
+type PgTableSizeFactory struct {
+	DiskCapacity float64
+}
 
 type PgTableSize struct {
 	datname    string
@@ -15,13 +19,19 @@ type PgTableSize struct {
 	n_dead_tup float64
 	size       float64
 	idx_size   float64
+	// collected_at - время снапшота в postgres, одно на все строки тика, по нему считается прирост в час и прогноз
+	collected_at float64
+	// size_growth, idx_size_growth - прирост size и idx_size в байтах в час с прошлого снапшота, в снапшот не входят
+	size_growth     float64
+	idx_size_growth float64
+	disk_capacity   float64
 }
 
 func (f *PgTableSizeFactory) Name() string {
 	return "PgTableSize"
 }
 
-func (f *PgTableSizeFactory) CollectQuery() string {
+func (f *PgTableSizeFactory) CollectQuery(serverVersion int) string {
 	//main query to get metrics
 	return `SELECT
 			  current_database() datname,
@@ -30,26 +40,51 @@ func (f *PgTableSizeFactory) CollectQuery() string {
 			  n_live_tup,
 			  n_dead_tup,
 			  pg_table_size(relid) AS size,
-			  pg_indexes_size(relid) AS idx_size
+			  pg_indexes_size(relid) AS idx_size,
+			  extract(epoch from now())::float8 AS collected_at
 			FROM pg_stat_user_tables 
 			WHERE schemaname NOT IN ('pg_catalog', 'pg_toast', 'information_schema')`
 }
 
-func (f *PgTableSizeFactory) PushQuery() string {
-	//query to store in clickhouse populated data with hostname
-	return `INSERT INTO pg.pg_table_size_buffer(
-						hostname,
-						datname,
-						schemaname,
-						tablename,
-						n_live_tup,
-						n_dead_tup,
-						size,
-						idx_size) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+func (f *PgTableSizeFactory) TableName() string {
+	return "pg_table_size"
+}
+
+func (f *PgTableSizeFactory) prerequisites() []prerequisite {
+	return []prerequisite{
+		viewReadable("pg_stat_user_tables"),
+	}
+}
+
+func (f *PgTableSizeFactory) PushColumns() []string {
+	return []string{
+		"hostname",
+		"datname",
+		"schemaname",
+		"tablename",
+		"n_live_tup",
+		"n_dead_tup",
+		"size",
+		"idx_size",
+		"size_growth",
+		"idx_size_growth",
+		"disk_capacity",
+		"collected_at",
+	}
+}
+
+// gaugeColumns - размеры и число строк текущие, прирост size_growth без прошлого снапшота не посчитать
+func (f *PgTableSizeFactory) gaugeColumns() []string {
+	return []string{"n_live_tup", "n_dead_tup", "size", "idx_size", "disk_capacity"}
+}
+
+func (f *PgTableSizeFactory) emptyMetric() PgMetric {
+	// disk_capacity не входит в fields, у метрик из снапшота на диске он берется из настроек
+	return &PgTableSize{disk_capacity: f.DiskCapacity}
 }
 
-func (f *PgTableSizeFactory) NewMetric(rows *sql.Rows) (PgMetric, error) {
-	metric := new(PgTableSize)
+func (f *PgTableSizeFactory) NewMetric(ctx context.Context, rows *sql.Rows) (PgMetric, error) {
+	metric := &PgTableSize{disk_capacity: f.DiskCapacity}
 
 	err := rows.Scan(
 		&metric.datname,
@@ -59,6 +94,7 @@ func (f *PgTableSizeFactory) NewMetric(rows *sql.Rows) (PgMetric, error) {
 		&metric.n_dead_tup,
 		&metric.size,
 		&metric.idx_size,
+		&metric.collected_at,
 	)
 	if err != nil {
 		return nil, err
@@ -75,21 +111,29 @@ func (p *PgTableSize) isSkippable(old PgMetric) bool {
 	return false
 }
 
+// delta - размеры остаются текущими, прирост в час считается по collected_at двух снапшотов, без него прирост нулевой
 func (p *PgTableSize) delta(old PgMetric) PgMetric {
-	_, ok := old.(*PgTableSize)
+	o, ok := old.(*PgTableSize)
 	if !ok {
 		panic(fmt.Sprintf("delta: this is not PgTableSize: %v", old))
 	}
 
-	return &PgTableSize{
-		datname:    p.datname,
-		schemaname: p.schemaname,
-		tablename:  p.tablename,
-		n_live_tup: p.n_live_tup,
-		n_dead_tup: p.n_dead_tup,
-		size:       p.size,
-		idx_size:   p.idx_size,
+	result := &PgTableSize{
+		datname:       p.datname,
+		schemaname:    p.schemaname,
+		tablename:     p.tablename,
+		n_live_tup:    p.n_live_tup,
+		n_dead_tup:    p.n_dead_tup,
+		size:          p.size,
+		idx_size:      p.idx_size,
+		collected_at:  p.collected_at,
+		disk_capacity: p.disk_capacity,
+	}
+	if hours := (p.collected_at - o.collected_at) / 3600; o.collected_at > 0 && hours > 0 {
+		result.size_growth = (p.size - o.size) / hours
+		result.idx_size_growth = (p.idx_size - o.idx_size) / hours
 	}
+	return result
 }
 
 func (p *PgTableSize) getHash() uint32 {
@@ -106,5 +150,34 @@ func (p *PgTableSize) getValue(hostname string) []interface{} {
 		&p.n_dead_tup,
 		&p.size,
 		&p.idx_size,
+		&p.size_growth,
+		&p.idx_size_growth,
+		&p.disk_capacity,
+		&p.collected_at,
 	}
 }
+
+func (p *PgTableSize) fields() []interface{} {
+	return []interface{}{
+		&p.datname,
+		&p.schemaname,
+		&p.tablename,
+		&p.n_live_tup,
+		&p.n_dead_tup,
+		&p.size,
+		&p.idx_size,
+		&p.collected_at,
+	}
+}
+
+func (p *PgTableSize) appendTo(strs []string, floats []float64) ([]string, []float64) {
+	strs = append(strs, p.datname, p.schemaname, p.tablename)
+	floats = append(floats,
+		p.n_live_tup,
+		p.n_dead_tup,
+		p.size,
+		p.idx_size,
+		p.collected_at,
+	)
+	return strs, floats
+}
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"context"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -44,11 +45,32 @@ func TestPgTableSize_Delta(t *testing.T) {
 	assert.Equal(t, expected, given.delta(given), "Delta should be mocked - return the same value")
 }
 
+func TestPgTableSize_Delta_Growth(t *testing.T) {
+	old := &PgTableSize{tablename: "test", size: 1000, idx_size: 100, collected_at: 3600}
+	current := &PgTableSize{tablename: "test", size: 3000, idx_size: 50, collected_at: 3 * 3600, disk_capacity: 1e12}
+
+	delta := current.delta(old).(*PgTableSize)
+	assert.Equal(t, float64(3000), delta.size, "size stays a gauge")
+	assert.Equal(t, float64(1000), delta.size_growth, "bytes per hour")
+	assert.Equal(t, float64(-25), delta.idx_size_growth)
+	assert.Equal(t, 1e12, delta.disk_capacity)
+
+	old.collected_at = 0
+	assert.Equal(t, float64(0), current.delta(old).(*PgTableSize).size_growth, "no time of the previous snapshot")
+}
+
 func TestStatsCollector_Push_PgTableSize(t *testing.T) {
-	sc, err := NewStatsCollector(&PgTableSizeFactory{}, "hostname", postgresDockerDsn, clickhouseDockerDsn, 60)
+	sc, err := NewStatsCollector(context.Background(), &PgTableSizeFactory{}, "hostname", postgresDockerDsn, clickhouseDockerDsn, 60, CollectorOptions{})
 	assert.Empty(t, err, "error init collector")
 
 	given := getMockPgTableSizeSlice()
 
-	assert.NoError(t, sc.Push(given), "error during push metrics")
+	assert.NoError(t, sc.Push(context.Background(), given, ""), "error during push metrics")
+}
+
+func TestPgTableSizeFactory_emptyMetric(t *testing.T) {
+	f := &PgTableSizeFactory{DiskCapacity: 1e12}
+	metric := f.emptyMetric().(*PgTableSize)
+	assert.Equal(t, 1e12, metric.disk_capacity, "restored snapshot keeps the configured capacity")
+	assert.Equal(t, len(f.PushColumns()), len(metric.getValue("hostname")))
 }
@@ -0,0 +1,255 @@
+package internal
+
+import (
+	"container/heap"
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+)
+
+// planColumns - колонки pg_query_plans без меток, в порядке queryPlan.values
+var planColumns = []string{
+	"hostname",
+	"datname",
+	"username",
+	"queryid",
+	"plan_hash",
+	"previous_plan_hash",
+	"plan_changed",
+	"calls",
+	"total_time",
+	"query",
+	"plan",
+}
+
+// planPrerequisites - PLAN_SAMPLE_TOP читает планы из pg_store_plans. auto_explain не подходит:
+// он пишет планы только в лог сервера, и в них нет queryid, по которому план связать с запросом
+var planPrerequisites = []prerequisite{
+	extensionInstalled("pg_store_plans"),
+	preloadLibrariesReadable,
+	preloadLibrary("pg_store_plans"),
+	viewReadable("pg_store_plans"),
+}
+
+// planSampler - на каждом тике PgStatStatements отбирает top запросов по дельте total_time
+// и берет из pg_store_plans их последний выполненный план. plans - последний план каждого запроса,
+// в clickhouse пишется только новый для процесса запрос или сменившийся план
+type planSampler struct {
+	top        int
+	statements statementHeap
+	plans      map[uint32]int64
+	// queryidColumn - колонка pg_store_plans с queryid из pg_stat_statements, зависит от версии расширения
+	queryidColumn string
+}
+
+// queryPlan - строка pg_query_plans
+type queryPlan struct {
+	datname          string
+	username         string
+	queryid          int64
+	planHash         int64
+	previousPlanHash int64
+	planChanged      bool
+	calls            float64
+	totalTime        float64
+	query            string
+	plan             string
+}
+
+func newPlanSampler(top int) *planSampler {
+	return &planSampler{top: top, plans: make(map[uint32]int64)}
+}
+
+// observe - дельта очередного запроса тика, в куче остаются top с наибольшим total_time.
+// Запросы без прошлого снапшота сюда не попадают: их total_time накоплен с reset-а, а не за интервал
+func (s *planSampler) observe(metric PgMetric) {
+	statement, ok := metric.(*PgStatStatement)
+	if !ok || statement.total_time <= 0 {
+		return
+	}
+	if len(s.statements) < s.top {
+		heap.Push(&s.statements, statement)
+		return
+	}
+	if statement.total_time > s.statements[0].total_time {
+		s.statements[0] = statement
+		heap.Fix(&s.statements, 0)
+	}
+}
+
+func (s *planSampler) reset() {
+	s.statements = s.statements[:0]
+}
+
+// take - top тика по убыванию total_time, куча очищается
+func (s *planSampler) take() []*PgStatStatement {
+	top := make([]*PgStatStatement, len(s.statements))
+	copy(top, s.statements)
+	s.reset()
+	sort.Slice(top, func(i, j int) bool { return top[i].total_time > top[j].total_time })
+	return top
+}
+
+// fetch - последний по last_call план каждого запроса из top. queryid pg_stat_statements снапшот хранит во float64,
+// поэтому запросы ищутся по queryid::float8, а в строку плана идет точный bigint
+func (s *planSampler) fetch(ctx context.Context, db *sql.DB, top []*PgStatStatement) ([]queryPlan, error) {
+	if len(top) == 0 {
+		return nil, nil
+	}
+	if s.queryidColumn == "" {
+		// до 1.5 queryid pg_store_plans свой, а queryid pg_stat_statements лежит в queryid_stat_statements
+		err := db.QueryRowContext(ctx, `SELECT CASE WHEN EXISTS (
+				SELECT 1 FROM pg_attribute
+				WHERE attrelid = 'pg_store_plans'::regclass AND attname = 'queryid_stat_statements' AND NOT attisdropped
+			) THEN 'queryid_stat_statements' ELSE 'queryid' END`).Scan(&s.queryidColumn)
+		if err != nil {
+			return nil, err
+		}
+	}
+	queryids := make([]float64, 0, len(top))
+	wanted := make(map[uint32]*PgStatStatement, len(top))
+	for _, statement := range top {
+		queryids = append(queryids, statement.queryid)
+		wanted[statement.getHash()] = statement
+	}
+
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`SELECT DISTINCT ON (p.%[1]s, p.dbid, p.userid)
+				p.%[1]s,
+				d.datname,
+				pg_catalog.pg_get_userbyid(p.userid) username,
+				p.planid,
+				p.plan
+			FROM pg_store_plans p
+			JOIN pg_database d ON p.dbid = d.oid
+			WHERE p.%[1]s::float8 = ANY($1)
+			ORDER BY p.%[1]s, p.dbid, p.userid, p.last_call DESC`, s.queryidColumn), queryids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var plans []queryPlan
+	for rows.Next() {
+		var plan queryPlan
+		if err = rows.Scan(&plan.queryid, &plan.datname, &plan.username, &plan.planHash, &plan.plan); err != nil {
+			return nil, err
+		}
+		statement, ok := wanted[plan.key()]
+		if !ok {
+			// тот же queryid в другой базе или у другого пользователя
+			continue
+		}
+		plan.calls, plan.totalTime, plan.query = statement.calls, statement.total_time, statement.query
+		plans = append(plans, plan)
+	}
+	return plans, rows.Err()
+}
+
+// changes - планы, которые надо записать: запрос впервые попал в top или у него сменился plan_hash
+func (s *planSampler) changes(plans []queryPlan) []queryPlan {
+	var changed []queryPlan
+	for _, plan := range plans {
+		previous, seen := s.plans[plan.key()]
+		if seen && previous == plan.planHash {
+			continue
+		}
+		plan.previousPlanHash, plan.planChanged = previous, seen
+		changed = append(changed, plan)
+	}
+	return changed
+}
+
+// remember - записанные планы становятся последними, до записи смена плана не теряется при недоступном clickhouse
+func (s *planSampler) remember(plans []queryPlan) {
+	for _, plan := range plans {
+		s.plans[plan.key()] = plan.planHash
+	}
+}
+
+// key - hash ключа запроса, как у PgStatStatement
+func (p queryPlan) key() uint32 {
+	return (&PgStatStatement{queryid: float64(p.queryid), datname: p.datname, username: p.username}).getHash()
+}
+
+func (p queryPlan) values(hostname string, labels Labels) []interface{} {
+	return append([]interface{}{
+		hostname,
+		p.datname,
+		p.username,
+		p.queryid,
+		p.planHash,
+		p.previousPlanHash,
+		boolToUInt8(p.planChanged),
+		p.calls,
+		p.totalTime,
+		p.query,
+		p.plan,
+	}, labels.values()...)
+}
+
+// samplePlans - планы top запросов прошедшего тика в pg_query_plans. Ошибка не валит тик: метрики уже отправлены
+func (sc *StatsCollector) samplePlans(ctx context.Context) error {
+	plans, err := sc.plans.fetch(ctx, sc.postgres, sc.plans.take())
+	if err != nil {
+		return fmt.Errorf("fetch plans failed with: %w", err)
+	}
+	changed := sc.plans.changes(plans)
+	if len(changed) == 0 {
+		return nil
+	}
+	labels := sc.labels.withInstance(sc.instance)
+	for _, plan := range changed {
+		if plan.planChanged {
+			sc.logger.Info("query plan changed", "queryid", plan.queryid, "datname", plan.datname, "username", plan.username,
+				"plan_hash", plan.planHash, "previous_plan_hash", plan.previousPlanHash)
+		}
+		if sc.dryRun {
+			sc.logger.Info("dry-run plan", "phase", "plans", "queryid", plan.queryid, "plan_hash", plan.planHash, "plan", plan.plan)
+		}
+	}
+	if sc.dryRun {
+		sc.plans.remember(changed)
+		return nil
+	}
+
+	err = sc.insertRows(ctx, sc.tables.plansTable(), append(append([]string{}, planColumns...), labels.columns()...), len(changed), func(i int) []interface{} {
+		return changed[i].values(sc.hostname, labels)
+	})
+	if err != nil {
+		return fmt.Errorf("push plans failed with: %w", err)
+	}
+	sc.plans.remember(changed)
+	sc.logger.Debug("phase done", "phase", "plans", "rows", len(changed))
+	return nil
+}
+
+// checkPlanSampler - требования PLAN_SAMPLE_TOP: pg_store_plans в postgres и таблица планов в clickhouse, ch nil - без clickhouse
+func checkPlanSampler(ctx context.Context, postgres *sql.DB, ch *sql.DB, collector string, table string) []CheckResult {
+	results := make([]CheckResult, 0, len(planPrerequisites)+1)
+	for _, p := range planPrerequisites {
+		results = append(results, CheckResult{Collector: collector, Target: "postgres", Check: p.name, Err: p.check(ctx, postgres), Hint: p.hint + ", or set PLAN_SAMPLE_TOP=0"})
+	}
+	if ch != nil {
+		results = append(results, CheckResult{Collector: collector, Target: "clickhouse", Check: "table " + table, Err: tableExists(ctx, ch, table), Hint: "run `pgstats-to-clickhouse migrate`"})
+	}
+	return results
+}
+
+// statementHeap - min-heap по total_time, в корне наименьший из top
+type statementHeap []*PgStatStatement
+
+func (h statementHeap) Len() int           { return len(h) }
+func (h statementHeap) Less(i, j int) bool { return h[i].total_time < h[j].total_time }
+func (h statementHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *statementHeap) Push(x interface{}) {
+	*h = append(*h, x.(*PgStatStatement))
+}
+
+func (h *statementHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
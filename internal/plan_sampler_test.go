@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"testing"
+)
+
+func statementWithTime(queryid float64, totalTime float64) *PgStatStatement {
+	return &PgStatStatement{queryid: queryid, datname: "postgres", username: "app", calls: 1, total_time: totalTime}
+}
+
+func TestPlanSampler_Observe(t *testing.T) {
+	s := newPlanSampler(2)
+	s.observe(statementWithTime(1, 10))
+	s.observe(statementWithTime(2, 30))
+	s.observe(statementWithTime(3, 0))
+	s.observe(getMockPgTableSize())
+	s.observe(statementWithTime(4, 20))
+	s.observe(statementWithTime(5, 5))
+
+	assert.Equal(t, []*PgStatStatement{statementWithTime(2, 30), statementWithTime(4, 20)}, s.take())
+	assert.Empty(t, s.take(), "take resets the top")
+}
+
+func TestPlanSampler_Changes(t *testing.T) {
+	s := newPlanSampler(10)
+	first := queryPlan{datname: "postgres", username: "app", queryid: -8070058914462478000, planHash: 11, plan: "Seq Scan"}
+
+	changed := s.changes([]queryPlan{first})
+	assert.Equal(t, []queryPlan{first}, changed, "a new statement is written without the change flag")
+	assert.Equal(t, changed, s.changes([]queryPlan{first}), "not written plan is written on the next tick")
+	s.remember(changed)
+	assert.Empty(t, s.changes([]queryPlan{first}), "the same plan is not written again")
+
+	second := first
+	second.planHash, second.plan = 12, "Index Scan"
+	expected := second
+	expected.previousPlanHash, expected.planChanged = 11, true
+	assert.Equal(t, []queryPlan{expected}, s.changes([]queryPlan{second}))
+}
+
+func TestQueryPlan_Values(t *testing.T) {
+	labels := Labels{Cluster: "main"}.withInstance(&PgInstance{})
+	values := queryPlan{planChanged: true}.values("hostname", labels)
+	assert.Len(t, values, len(planColumns)+len(labels.columns()))
+	assert.Equal(t, uint8(1), values[6])
+	assert.Equal(t, []interface{}{"primary", "main"}, values[len(planColumns):])
+}
+
+func TestStreamMerge_PlanSampler(t *testing.T) {
+	sc := &StatsCollector{cf: &PgStatStatementsFactory{}, logger: slog.Default(), pushMaxRows: 10, plans: newPlanSampler(1),
+		snapshot: snapshotOf(1, statementWithTime(1, 100), statementWithTime(2, 10))}
+	push := func(ctx context.Context, batch []PgMetric, token string) error {
+		return nil
+	}
+	// у нового запроса total_time накоплен с reset-а, в top по интервалу он не попадает
+	current := []PgMetric{statementWithTime(1, 105), statementWithTime(2, 30), statementWithTime(3, 1000)}
+	current[0].(*PgStatStatement).calls, current[1].(*PgStatStatement).calls = 2, 2
+
+	sc.streamMerge(context.Background(), scanOf(current, nil), push)
+	top := sc.plans.take()
+	if assert.Len(t, top, 1) {
+		assert.Equal(t, float64(2), top[0].queryid, "top is by delta, not by cumulative total_time")
+		assert.Equal(t, float64(20), top[0].total_time)
+	}
+}
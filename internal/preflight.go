@@ -0,0 +1,367 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	// PreflightOff - требования не проверяются, коллектор падает на первом тике и перезапускается
+	PreflightOff = "off"
+	// PreflightDisable - коллектор, которому не хватает требований, выключается, остальные работают
+	PreflightDisable = "disable"
+	// PreflightFail - демон останавливается, если хоть одному коллектору не хватает требований
+	PreflightFail = "fail"
+)
+
+// prerequisite - проверка в postgres: query возвращает один bool, hint - что сделать, если false
+type prerequisite struct {
+	name  string
+	query string
+	args  []interface{}
+	hint  string
+}
+
+// commonPrerequisites нужны каждому коллектору: Init читает system_identifier и время старта инстанса
+var commonPrerequisites = []prerequisite{
+	{
+		name:  "function pg_control_system()",
+		query: `SELECT has_function_privilege('pg_control_system()', 'EXECUTE')`,
+		hint:  "GRANT EXECUTE ON FUNCTION pg_control_system() TO <user>",
+	},
+}
+
+func roleMember(role string, why string) prerequisite {
+	return prerequisite{
+		name:  "role " + role,
+		query: `SELECT pg_has_role(current_user, $1, 'MEMBER') OR (SELECT rolsuper FROM pg_roles WHERE rolname = current_user)`,
+		args:  []interface{}{role},
+		hint:  fmt.Sprintf("GRANT pg_monitor TO <user>: %s", why),
+	}
+}
+
+func extensionInstalled(extension string) prerequisite {
+	return prerequisite{
+		name:  "extension " + extension,
+		query: `SELECT EXISTS(SELECT 1 FROM pg_extension WHERE extname = $1)`,
+		args:  []interface{}{extension},
+		hint:  fmt.Sprintf("CREATE EXTENSION %s in the database of the dsn", extension),
+	}
+}
+
+// preloadLibrariesReadable - shared_preload_libraries видят только суперпользователь и члены pg_read_all_settings (входит в pg_monitor),
+// остальным current_setting отдает ошибку прав, а с missing_ok - NULL. Ставится перед preloadLibrary
+var preloadLibrariesReadable = prerequisite{
+	name:  "setting shared_preload_libraries",
+	query: `SELECT current_setting('shared_preload_libraries', true) IS NOT NULL`,
+	hint:  "GRANT pg_read_all_settings TO <user> (included in pg_monitor) to read shared_preload_libraries",
+}
+
+// preloadLibrary - без прав на чтение настройки проверка проходит, ее непрохождение показывает preloadLibrariesReadable
+func preloadLibrary(library string) prerequisite {
+	return prerequisite{
+		name:  "shared_preload_libraries " + library,
+		query: `SELECT coalesce($1 = ANY(string_to_array(replace(current_setting('shared_preload_libraries', true), ' ', ''), ',')), true)`,
+		args:  []interface{}{library},
+		hint:  fmt.Sprintf("add %s to shared_preload_libraries and restart postgres", library),
+	}
+}
+
+func viewReadable(view string) prerequisite {
+	return prerequisite{
+		name:  "view " + view,
+		query: `SELECT CASE WHEN to_regclass($1) IS NULL THEN false ELSE has_table_privilege($1, 'SELECT') END`,
+		args:  []interface{}{view},
+		hint:  fmt.Sprintf("%s is not found in search_path or SELECT is not granted", view),
+	}
+}
+
+// CheckResult - результат одной проверки команды check, Err == nil если проверка прошла
+type CheckResult struct {
+	Collector string
+	Target    string
+	Check     string
+	Err       error
+	Hint      string
+}
+
+// Check проверяет доступность postgres и clickhouse и права для каждого включенного коллектора
+func Check(ctx context.Context, cfg *Config) []CheckResult {
+	var results []CheckResult
+	for _, spec := range CollectorSpecs(cfg) {
+		results = append(results, checkPostgres(ctx, spec.Factory, spec.PostgresDsn, spec.PostgresDsnEnv)...)
+		results = append(results, checkClickhouse(ctx, spec.Factory, spec.Tables.pushTable(spec.Factory), spec.Labels, cfg.ClickhouseDsn)...)
+		if _, ok := spec.Factory.(*PgStatStatementsFactory); ok && cfg.PlanSampleTop > 0 {
+			results = append(results, checkPlans(ctx, spec, cfg.ClickhouseDsn)...)
+		}
+	}
+	return results
+}
+
+// checkPlans - требования PLAN_SAMPLE_TOP для check. Ошибки подключения уже показаны проверками коллектора
+func checkPlans(ctx context.Context, spec CollectorSpec, clickhouseDsn string) []CheckResult {
+	postgres, err := sql.Open("pgx", spec.PostgresDsn)
+	if err != nil {
+		return nil
+	}
+	defer postgres.Close()
+	ch, err := sql.Open("clickhouse", clickhouseDsn)
+	if err != nil {
+		return nil
+	}
+	defer ch.Close()
+	if postgres.PingContext(ctx) != nil || ch.PingContext(ctx) != nil {
+		return nil
+	}
+	return checkPlanSampler(ctx, postgres, ch, spec.Factory.Name(), spec.Tables.plansTable())
+}
+
+// checkPostgres - dsnEnv - настройка с dsn коллектора, POSTGRES_DSN или STATIO_POSTGRES_DSN
+func checkPostgres(ctx context.Context, cf CollectorFactory, dsn string, dsnEnv string) []CheckResult {
+	result := func(check string, err error, hint string) CheckResult {
+		return CheckResult{Collector: cf.Name(), Target: "postgres", Check: check, Err: err, Hint: hint}
+	}
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return []CheckResult{result("connect", err, "check "+dsnEnv)}
+	}
+	defer db.Close()
+	if err = db.PingContext(ctx); err != nil {
+		return []CheckResult{result("connect", err, "check "+dsnEnv+" and pg_hba.conf")}
+	}
+
+	return append([]CheckResult{result("connect", nil, "")}, checkPrerequisites(ctx, db, cf)...)
+}
+
+// checkPrerequisites проверяет в postgres общие и специфичные для коллектора требования
+func checkPrerequisites(ctx context.Context, db *sql.DB, cf CollectorFactory) []CheckResult {
+	prerequisites := append(append([]prerequisite{}, commonPrerequisites...), cf.prerequisites()...)
+	results := make([]CheckResult, 0, len(prerequisites))
+	for _, p := range prerequisites {
+		results = append(results, CheckResult{Collector: cf.Name(), Target: "postgres", Check: p.name, Err: p.check(ctx, db), Hint: p.hint})
+	}
+	return results
+}
+
+func (p prerequisite) check(ctx context.Context, db *sql.DB) error {
+	var ok bool
+	if err := db.QueryRowContext(ctx, p.query, p.args...).Scan(&ok); err != nil {
+		return err
+	}
+	if !ok {
+		return unmet("not satisfied")
+	}
+	return nil
+}
+
+// unmetError - требование проверено и не выполнено. Ошибки запросов и подключения им не являются:
+// сеть или таймаут могут пройти, и такую проверку стоит повторить
+type unmetError struct {
+	reason string
+}
+
+func (e *unmetError) Error() string {
+	return e.reason
+}
+
+func unmet(format string, args ...interface{}) error {
+	return &unmetError{reason: fmt.Sprintf(format, args...)}
+}
+
+// unmet - проверка выполнилась и требование не выполнено
+func (r CheckResult) unmet() bool {
+	var u *unmetError
+	return errors.As(r.Err, &u)
+}
+
+func checkClickhouse(ctx context.Context, cf CollectorFactory, table string, labels Labels, dsn string) []CheckResult {
+	result := func(check string, err error, hint string) CheckResult {
+		return CheckResult{Collector: cf.Name(), Target: "clickhouse", Check: check, Err: err, Hint: hint}
+	}
+	db, err := sql.Open("clickhouse", dsn)
+	if err != nil {
+		return []CheckResult{result("connect", err, "check CLICKHOUSE_DSN")}
+	}
+	defer db.Close()
+	if err = db.PingContext(ctx); err != nil {
+		return []CheckResult{result("connect", err, "check the dsn, user and password")}
+	}
+
+	return append([]CheckResult{result("connect", nil, "")}, checkClickhouseSchema(ctx, db, cf, table, labels, false)...)
+}
+
+// checkClickhouseSchema проверяет, что таблица для INSERT есть, в ней есть все колонки PushColumns и меток,
+// и их типы подходят под значения getValue. С addMissing недостающие колонки добавляются
+func checkClickhouseSchema(ctx context.Context, db *sql.DB, cf CollectorFactory, table string, labels Labels, addMissing bool) []CheckResult {
+	result := func(check string, err error, hint string) CheckResult {
+		return CheckResult{Collector: cf.Name(), Target: "clickhouse", Check: check, Err: err, Hint: hint}
+	}
+	if err := tableExists(ctx, db, table); err != nil {
+		return []CheckResult{result("table "+table, err, "run `pgstats-to-clickhouse migrate`, or GRANT SHOW TABLES, INSERT ON "+table+" TO <user>")}
+	}
+	results := []CheckResult{result("table "+table, nil, "")}
+
+	existing, err := tableColumns(ctx, db, table)
+	if err != nil {
+		return append(results, result("columns of "+table, err, ""))
+	}
+	missing, mismatched := compareColumns(pushColumns(cf, labels), existing)
+	if len(missing) > 0 && addMissing {
+		if err = addColumns(ctx, db, table, missing); err != nil {
+			return append(results, result("columns of "+table, err, "GRANT ALTER ADD COLUMN ON "+table+" TO <user>, or add the columns manually"))
+		}
+		missing = nil
+	}
+	var missingErr, mismatchedErr error
+	if len(missing) > 0 {
+		names := make([]string, 0, len(missing))
+		for _, c := range missing {
+			names = append(names, c.name)
+		}
+		missingErr = unmet("missing columns: %s", strings.Join(names, ", "))
+	}
+	if len(mismatched) > 0 {
+		mismatchedErr = unmet("incompatible types: %s", strings.Join(mismatched, "; "))
+	}
+	return append(results,
+		result("columns of "+table, missingErr, "add the columns, or set CLICKHOUSE_ADD_COLUMNS=true to add them as Nullable on start"),
+		result("column types of "+table, mismatchedErr, "ALTER TABLE ... MODIFY COLUMN to the expected type"),
+	)
+}
+
+// tableExists - system.tables показывает только таблицы, на которые у пользователя есть хоть какие-то права
+func tableExists(ctx context.Context, db *sql.DB, table string) error {
+	database, name := splitTableName(table)
+	var count uint64
+	err := db.QueryRowContext(ctx,
+		`SELECT count() FROM system.tables WHERE database = if(? = '', currentDatabase(), ?) AND name = ?`,
+		database, database, name,
+	).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return unmet("not found")
+	}
+	return nil
+}
+
+// PreflightError - коллектору не хватает прав, расширений или таблиц, повторные попытки не помогут
+type PreflightError struct {
+	Failed []CheckResult
+}
+
+func (e *PreflightError) Error() string {
+	messages := make([]string, 0, len(e.Failed))
+	for _, r := range e.Failed {
+		message := fmt.Sprintf("%s %s: %s", r.Target, r.Check, r.Err)
+		if r.Hint != "" {
+			message += " (" + r.Hint + ")"
+		}
+		messages = append(messages, message)
+	}
+	return "prerequisites are not met: " + strings.Join(messages, "; ")
+}
+
+// newPreflightError - nil, если все проверки прошли
+func newPreflightError(results []CheckResult) error {
+	var failed []CheckResult
+	for _, r := range results {
+		if r.Err != nil {
+			failed = append(failed, r)
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return &PreflightError{Failed: failed}
+}
+
+// retryableCheckError - ошибка запроса одной из проверок: обычная ошибка Init, которую WaitReady повторит с backoff
+func retryableCheckError(results []CheckResult) error {
+	for _, r := range results {
+		if r.Err != nil && !r.unmet() {
+			return fmt.Errorf("preflight %s %s failed with: %w", r.Target, r.Check, r.Err)
+		}
+	}
+	return nil
+}
+
+// runPreflight проверяет требования коллектора один раз, после первого успешного подключения.
+// Невыполненное требование запоминается: повторять Init бессмысленно, пока не поменяют права или схему.
+// Ошибка запроса проверки не запоминается, Init повторится
+func (sc *StatsCollector) runPreflight(ctx context.Context) error {
+	if sc.preflight == PreflightOff || sc.preflightPassed {
+		return nil
+	}
+	if sc.preflightErr != nil {
+		return sc.preflightErr
+	}
+	results := checkPrerequisites(ctx, sc.postgres, sc.cf)
+	if !sc.dryRun {
+		results = append(results, checkClickhouseSchema(ctx, sc.ch, sc.cf, sc.tables.pushTable(sc.cf), sc.labels, sc.addColumns)...)
+	}
+	if err := newPreflightError(results); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if retryErr := retryableCheckError(results); retryErr != nil {
+			return retryErr
+		}
+		sc.preflightErr = err
+		return err
+	}
+	if sc.plans != nil {
+		ch := sc.ch
+		if sc.dryRun {
+			ch = nil
+		}
+		// без pg_store_plans коллектор продолжает писать метрики, выключается только сэмплер
+		results := checkPlanSampler(ctx, sc.postgres, ch, sc.cf.Name(), sc.tables.plansTable())
+		if err := newPreflightError(results); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if retryErr := retryableCheckError(results); retryErr != nil {
+				return retryErr
+			}
+			sc.logger.Warn("plan sampling is disabled", "error", err)
+			sc.plans = nil
+		}
+	}
+	sc.preflightPassed = true
+	return nil
+}
+
+// splitTableName - "db.table" в (db, table), для имени без базы db пустая
+func splitTableName(table string) (string, string) {
+	if i := strings.Index(table, "."); i >= 0 {
+		return table[:i], table[i+1:]
+	}
+	return "", table
+}
+
+// WriteCheckResults печатает результаты check таблицей и возвращает количество непройденных проверок
+func WriteCheckResults(w io.Writer, results []CheckResult) (int, error) {
+	failed := 0
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, r := range results {
+		status, detail := "OK", ""
+		if r.Err != nil {
+			failed++
+			status, detail = "FAIL", r.Err.Error()
+			if r.Hint != "" {
+				detail += "; " + r.Hint
+			}
+		}
+		if _, err := fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", status, r.Collector, r.Target, r.Check, detail); err != nil {
+			return failed, err
+		}
+	}
+	return failed, tw.Flush()
+}
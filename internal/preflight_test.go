@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestSplitTableName(t *testing.T) {
+	database, name := splitTableName("pg.pg_stat_statements_buffer")
+	assert.Equal(t, "pg", database)
+	assert.Equal(t, "pg_stat_statements_buffer", name)
+
+	database, name = splitTableName("pg_table_size")
+	assert.Equal(t, "", database)
+	assert.Equal(t, "pg_table_size", name)
+}
+
+func TestCheck_Unavailable(t *testing.T) {
+	results := Check(context.Background(), getDownConfig())
+
+	// по проверке connect на postgres и clickhouse для каждого из трех коллекторов, дальше не идем
+	assert.Len(t, results, 6)
+	for _, r := range results {
+		assert.Equal(t, "connect", r.Check)
+		assert.Error(t, r.Err)
+	}
+	assert.Equal(t, "check POSTGRES_DSN and pg_hba.conf", results[0].Hint)
+	assert.Equal(t, "check STATIO_POSTGRES_DSN and pg_hba.conf", results[2].Hint, "PgStatioTable connects with its own dsn")
+}
+
+func TestWriteCheckResults(t *testing.T) {
+	results := []CheckResult{
+		{Collector: "PgStatStatements", Target: "postgres", Check: "connect"},
+		{Collector: "PgStatStatements", Target: "postgres", Check: "extension pg_stat_statements", Err: errors.New("not satisfied"), Hint: "CREATE EXTENSION pg_stat_statements"},
+	}
+	var buf bytes.Buffer
+	failed, err := WriteCheckResults(&buf, results)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, failed)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 2)
+	assert.True(t, strings.HasPrefix(lines[0], "OK "))
+	assert.True(t, strings.HasPrefix(lines[1], "FAIL "))
+	assert.Contains(t, lines[1], "not satisfied; CREATE EXTENSION pg_stat_statements")
+}
+
+func TestNewPreflightError(t *testing.T) {
+	assert.NoError(t, newPreflightError([]CheckResult{{Check: "connect"}}))
+
+	err := newPreflightError([]CheckResult{
+		{Target: "postgres", Check: "connect"},
+		{Target: "postgres", Check: "role pg_read_all_stats", Err: errors.New("not satisfied"), Hint: "GRANT pg_monitor TO <user>"},
+		{Target: "clickhouse", Check: "columns of pg.t", Err: errors.New("missing columns: a")},
+	})
+	var preflightErr *PreflightError
+	assert.True(t, errors.As(err, &preflightErr))
+	assert.Len(t, preflightErr.Failed, 2)
+	assert.Equal(t, "prerequisites are not met: postgres role pg_read_all_stats: not satisfied (GRANT pg_monitor TO <user>); clickhouse columns of pg.t: missing columns: a", err.Error())
+}
+
+func TestRetryableCheckError(t *testing.T) {
+	unmetResults := []CheckResult{
+		{Target: "postgres", Check: "role pg_read_all_stats", Err: unmet("not satisfied")},
+		{Target: "clickhouse", Check: "columns of pg.t", Err: unmet("missing columns: %s", "a")},
+	}
+	assert.True(t, unmetResults[0].unmet())
+	assert.NoError(t, retryableCheckError(unmetResults), "unmet prerequisites disable the collector")
+
+	results := append(unmetResults, CheckResult{Target: "clickhouse", Check: "columns of pg.t", Err: errors.New("code: 500, read timeout")})
+	assert.False(t, results[2].unmet())
+	err := retryableCheckError(results)
+	if assert.Error(t, err, "query errors are retried") {
+		assert.Equal(t, "preflight clickhouse columns of pg.t failed with: code: 500, read timeout", err.Error())
+		var preflightErr *PreflightError
+		assert.False(t, errors.As(err, &preflightErr))
+	}
+}
@@ -0,0 +1,204 @@
+package internal
+
+import (
+	"context"
+	"errors"
+)
+
+const (
+	// defaultRegressionMinCalls - REGRESSION_MIN_CALLS по умолчанию
+	defaultRegressionMinCalls = 10
+	// regressionBaselineIntervals - baseline это EWMA примерно по стольким последним интервалам
+	regressionBaselineIntervals = 10
+	// regressionWarmup - сколько интервалов копится baseline нового для процесса запроса, прежде чем его сравнивать
+	regressionWarmup = 5
+	// regressionForgetTicks - baseline запроса, которого не было в дельтах столько тиков, удаляется
+	regressionForgetTicks = 1000
+
+	reasonLatency = "latency"
+	reasonRows    = "rows"
+)
+
+// regressionDetector - сравнивает время и rows на вызов запроса за интервал с их baseline в памяти
+// и отдает событие с reason latency или rows, когда значение выросло в factor раз. Событие одно на регрессию:
+// пока запрос медленный, повторных нет, а baseline догоняет новое значение примерно за regressionBaselineIntervals интервалов.
+// После рестарта baseline копится заново
+type regressionDetector struct {
+	factor    float64
+	minCalls  float64
+	tick      int64
+	baselines map[uint32]*latencyBaseline
+	events    []regressionEvent
+}
+
+type latencyBaseline struct {
+	latency float64
+	rows    float64
+	samples int
+	// latencyRegressed, rowsRegressed - событие уже отдано, следующее только после возврата под factor
+	latencyRegressed bool
+	rowsRegressed    bool
+	lastTick         int64
+}
+
+// regressionEvent - строка pg_query_regressions и элемент вебхука. Reason - что выросло в Ratio раз: latency или rows на вызов
+type regressionEvent struct {
+	Datname  string `json:"datname"`
+	Username string `json:"username"`
+	// QueryID - queryid из снапшота, где он float64: младшие биты больших значений потеряны,
+	// с pg_query_plans сравнивается через toFloat64(queryid)
+	QueryID             int64   `json:"queryid"`
+	Query               string  `json:"query"`
+	Reason              string  `json:"reason"`
+	Calls               float64 `json:"calls"`
+	Latency             float64 `json:"latency_ms"`
+	BaselineLatency     float64 `json:"baseline_latency_ms"`
+	Ratio               float64 `json:"ratio"`
+	RowsPerCall         float64 `json:"rows_per_call"`
+	BaselineRowsPerCall float64 `json:"baseline_rows_per_call"`
+}
+
+// regressionColumns - колонки pg_query_regressions без меток, в порядке regressionEvent.values
+var regressionColumns = []string{
+	"hostname",
+	"datname",
+	"username",
+	"queryid",
+	"query",
+	"reason",
+	"calls",
+	"latency",
+	"baseline_latency",
+	"ratio",
+	"rows_per_call",
+	"baseline_rows_per_call",
+}
+
+func newRegressionDetector(factor float64, minCalls int) *regressionDetector {
+	return &regressionDetector{factor: factor, minCalls: float64(minCalls), baselines: make(map[uint32]*latencyBaseline)}
+}
+
+// begin - начало тика, события прошлого тика сбрасываются
+func (d *regressionDetector) begin() {
+	d.tick++
+	d.events = nil
+}
+
+// observe - дельта запроса за интервал. Интервалы меньше чем с minCalls вызовами слишком шумные,
+// они не сравниваются и не попадают в baseline
+func (d *regressionDetector) observe(metric PgMetric) {
+	statement, ok := metric.(*PgStatStatement)
+	if !ok || statement.calls < d.minCalls || statement.calls <= 0 {
+		return
+	}
+	latency, rows := statement.total_time/statement.calls, statement.rows/statement.calls
+	key := statement.getHash()
+	baseline, ok := d.baselines[key]
+	if !ok {
+		d.baselines[key] = &latencyBaseline{latency: latency, rows: rows, samples: 1, lastTick: d.tick}
+		return
+	}
+	baseline.lastTick = d.tick
+	if baseline.samples >= regressionWarmup {
+		baseline.latencyRegressed = d.compare(statement, baseline, reasonLatency, latency, baseline.latency, baseline.latencyRegressed)
+		baseline.rowsRegressed = d.compare(statement, baseline, reasonRows, rows, baseline.rows, baseline.rowsRegressed)
+	}
+	alpha := 2.0 / (regressionBaselineIntervals + 1)
+	baseline.latency += alpha * (latency - baseline.latency)
+	baseline.rows += alpha * (rows - baseline.rows)
+	baseline.samples++
+}
+
+// compare - отдает событие reason, если value выросло в factor раз относительно base и события еще не было.
+// Возвращает, в регрессии ли запрос по reason. При нулевом base сравнивать не с чем
+func (d *regressionDetector) compare(statement *PgStatStatement, baseline *latencyBaseline, reason string, value float64, base float64, regressed bool) bool {
+	if base <= 0 {
+		return false
+	}
+	ratio := value / base
+	if ratio >= d.factor && !regressed {
+		d.events = append(d.events, regressionEvent{
+			Datname:             statement.datname,
+			Username:            statement.username,
+			QueryID:             int64(statement.queryid),
+			Query:               statement.query,
+			Reason:              reason,
+			Calls:               statement.calls,
+			Latency:             statement.total_time / statement.calls,
+			BaselineLatency:     baseline.latency,
+			Ratio:               ratio,
+			RowsPerCall:         statement.rows / statement.calls,
+			BaselineRowsPerCall: baseline.rows,
+		})
+	}
+	return ratio >= d.factor
+}
+
+// end - события тика; заодно забываются запросы, которых давно нет, чтобы map не росла от разовых запросов
+func (d *regressionDetector) end() []regressionEvent {
+	for key, baseline := range d.baselines {
+		if d.tick-baseline.lastTick > regressionForgetTicks {
+			delete(d.baselines, key)
+		}
+	}
+	return d.events
+}
+
+func (e regressionEvent) values(hostname string, labels Labels) []interface{} {
+	return append([]interface{}{
+		hostname,
+		e.Datname,
+		e.Username,
+		e.QueryID,
+		e.Query,
+		e.Reason,
+		e.Calls,
+		e.Latency,
+		e.BaselineLatency,
+		e.Ratio,
+		e.RowsPerCall,
+		e.BaselineRowsPerCall,
+	}, labels.values()...)
+}
+
+// regressionPayload - тело REGRESSION_WEBHOOK: все регрессии тика одним запросом
+type regressionPayload struct {
+	Event       string            `json:"event"`
+	Collector   string            `json:"collector"`
+	Hostname    string            `json:"hostname"`
+	Instance    string            `json:"instance"`
+	Labels      map[string]string `json:"labels"`
+	Regressions []regressionEvent `json:"regressions"`
+}
+
+// pushRegressions - регрессии тика в лог, pg_query_regressions и вебхук. Ошибки не валят тик, как и у планов
+func (sc *StatsCollector) pushRegressions(ctx context.Context, events []regressionEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	labels := sc.labels.withInstance(sc.instance)
+	for _, e := range events {
+		sc.logger.Warn("query regression", "datname", e.Datname, "username", e.Username, "queryid", e.QueryID, "reason", e.Reason,
+			"latency_ms", e.Latency, "baseline_latency_ms", e.BaselineLatency, "ratio", e.Ratio,
+			"rows_per_call", e.RowsPerCall, "baseline_rows_per_call", e.BaselineRowsPerCall, "query", e.Query)
+	}
+	if sc.dryRun {
+		return nil
+	}
+
+	var chErr, webhookErr error
+	if sc.regressionWebhook != nil {
+		webhookErr = sc.regressionWebhook.send(ctx, regressionPayload{
+			Event:       "query_regression",
+			Collector:   sc.cf.Name(),
+			Hostname:    sc.hostname,
+			Instance:    sc.instanceName,
+			Labels:      labels.toMap(),
+			Regressions: events,
+		})
+	}
+	chErr = sc.insertRows(ctx, sc.tables.regressionsTable(), append(append([]string{}, regressionColumns...), labels.columns()...), len(events), func(i int) []interface{} {
+		return events[i].values(sc.hostname, labels)
+	})
+	return errors.Join(wrapErr("push regressions failed with", chErr), wrapErr("regression webhook failed with", webhookErr))
+}
@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"testing"
+)
+
+func statementWithLatency(calls float64, latency float64) *PgStatStatement {
+	return &PgStatStatement{queryid: 1, datname: "postgres", username: "app", query: "SELECT 1", calls: calls, total_time: calls * latency, rows: calls}
+}
+
+// observeTicks - по одному тику на каждую латентность, события всех тиков
+func observeTicks(d *regressionDetector, calls float64, latencies ...float64) []regressionEvent {
+	var events []regressionEvent
+	for _, latency := range latencies {
+		d.begin()
+		d.observe(statementWithLatency(calls, latency))
+		events = append(events, d.end()...)
+	}
+	return events
+}
+
+func TestRegressionDetector_Warmup(t *testing.T) {
+	d := newRegressionDetector(2, 10)
+	assert.Empty(t, observeTicks(d, 100, 1, 1, 1, 1, 10), "baseline is not compared before warmup")
+}
+
+func TestRegressionDetector_Regression(t *testing.T) {
+	d := newRegressionDetector(2, 10)
+	assert.Empty(t, observeTicks(d, 100, 1, 1, 1, 1, 1, 1.5))
+
+	events := observeTicks(d, 100, 4, 4, 4)
+	if assert.Len(t, events, 1, "one event per regression") {
+		assert.Equal(t, "SELECT 1", events[0].Query)
+		assert.Equal(t, reasonLatency, events[0].Reason)
+		assert.Equal(t, int64(1), events[0].QueryID)
+		assert.Equal(t, float64(4), events[0].Latency)
+		assert.InDelta(t, 1.09, events[0].BaselineLatency, 0.01)
+		assert.InDelta(t, 3.66, events[0].Ratio, 0.01)
+		assert.Equal(t, float64(1), events[0].RowsPerCall)
+	}
+
+	assert.Empty(t, observeTicks(d, 100, 1), "recovered")
+	assert.Len(t, observeTicks(d, 100, 10), 1, "new regression after recovery")
+}
+
+func TestRegressionDetector_Rows(t *testing.T) {
+	d := newRegressionDetector(2, 10)
+	observeTicks(d, 100, 1, 1, 1, 1, 1)
+
+	var events []regressionEvent
+	for i := 0; i < 2; i++ {
+		d.begin()
+		statement := statementWithLatency(100, 1)
+		statement.rows = 100 * 5
+		d.observe(statement)
+		events = append(events, d.end()...)
+	}
+	if assert.Len(t, events, 1, "one event per regression") {
+		assert.Equal(t, reasonRows, events[0].Reason)
+		assert.Equal(t, float64(5), events[0].RowsPerCall)
+		assert.Equal(t, float64(1), events[0].BaselineRowsPerCall)
+		assert.InDelta(t, 5, events[0].Ratio, 0.01)
+		assert.Equal(t, float64(1), events[0].Latency, "latency is unchanged")
+	}
+}
+
+func TestRegressionDetector_MinCalls(t *testing.T) {
+	d := newRegressionDetector(2, 10)
+	observeTicks(d, 100, 1, 1, 1, 1, 1)
+	assert.Empty(t, observeTicks(d, 5, 100), "few calls are noise")
+	assert.Len(t, observeTicks(d, 100, 100), 1)
+
+	d.begin()
+	d.observe(getMockPgTableSize())
+	assert.Empty(t, d.end())
+}
+
+func TestRegressionDetector_Forget(t *testing.T) {
+	d := newRegressionDetector(2, 10)
+	observeTicks(d, 100, 1)
+	for i := 0; i <= regressionForgetTicks; i++ {
+		d.begin()
+		d.end()
+	}
+	assert.Empty(t, d.baselines)
+}
+
+func TestRegressionEvent_Values(t *testing.T) {
+	labels := Labels{Cluster: "main"}.withInstance(&PgInstance{})
+	values := regressionEvent{Ratio: 3}.values("hostname", labels)
+	assert.Len(t, values, len(regressionColumns)+len(labels.columns()))
+	assert.Equal(t, float64(3), values[9])
+	assert.Equal(t, []interface{}{"primary", "main"}, values[len(regressionColumns):])
+}
+
+func TestStreamMerge_RegressionDetector(t *testing.T) {
+	sc := &StatsCollector{cf: &PgStatStatementsFactory{}, logger: slog.Default(), pushMaxRows: 10, regressions: newRegressionDetector(2, 1),
+		snapshot: snapshotOf(1, statementWithLatency(100, 1))}
+	push := func(ctx context.Context, batch []PgMetric, token string) error {
+		return nil
+	}
+	current := []PgMetric{statementWithLatency(200, 1), statementWithLatency(1, 1)}
+	current[1].(*PgStatStatement).queryid = 2
+
+	sc.streamMerge(context.Background(), scanOf(current, nil), push)
+	sc.regressions.end()
+	if assert.Len(t, sc.regressions.baselines, 1, "a statement new for the snapshot is not a delta") {
+		assert.Equal(t, float64(1), sc.regressions.baselines[statementWithLatency(1, 1).getHash()].latency)
+	}
+}
@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var defaultShutdownTimeout = 10 * time.Second
+
+// Run тикает коллектор каждые interval до отмены ctx, предварительно дождавшись готовности.
+// После отмены ctx тикер останавливается, текущий тик доделывается и, если включен flushOnShutdown,
+// выполняется последний тик, чтобы не потерять неполный интервал. Все это ограничено shutdownTimeout,
+// по его истечении незавершенные запросы отменяются.
+func (sc *StatsCollector) Run(ctx context.Context, interval time.Duration) error {
+	if err := sc.WaitReady(ctx); err != nil {
+		if ctx.Err() != nil {
+			// остановили раньше, чем коллектор стал ready - отправлять нечего
+			return nil
+		}
+		return err
+	}
+	sc.logger.Info("collector started")
+
+	workCtx, cancelWork := context.WithCancel(context.Background())
+	defer cancelWork()
+	go func() {
+		select {
+		case <-workCtx.Done():
+			return
+		case <-ctx.Done():
+		}
+		timer := time.NewTimer(sc.shutdownTimeout)
+		defer timer.Stop()
+		select {
+		case <-workCtx.Done():
+		case <-timer.C:
+			sc.logger.Warn("shutdown timeout exceeded, cancelling in-flight work", "timeout", sc.shutdownTimeout)
+			cancelWork()
+		}
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			ticker.Stop()
+			if sc.flushOnShutdown && workCtx.Err() == nil {
+				sc.logger.Info("flushing the last interval")
+				sc.tick(workCtx)
+			}
+			return nil
+		case <-ticker.C:
+			sc.tick(workCtx)
+		}
+	}
+}
+
+func (sc *StatsCollector) tick(ctx context.Context) {
+	sc.health.start()
+	start := time.Now()
+	err := sc.Tick(ctx)
+	sc.health.record(err)
+	if err != nil && !errors.Is(err, ErrCircuitOpen) {
+		sc.logger.Error("tick failed", "duration", time.Since(start), "error", err)
+	}
+}
+
+// tickHealth - результат последних тиков, читается из других горутин
+type tickHealth struct {
+	mu          sync.Mutex
+	started     time.Time
+	lastTick    time.Time
+	lastSuccess time.Time
+	lastErr     error
+}
+
+func (h *tickHealth) start() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.started = time.Now()
+}
+
+// finish - работа вне тика закончилась, результат тиков не меняется
+func (h *tickHealth) finish() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.started = time.Time{}
+}
+
+func (h *tickHealth) record(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.started = time.Time{}
+	h.lastTick = time.Now()
+	h.lastErr = err
+	if err == nil {
+		h.lastSuccess = h.lastTick
+	}
+}
+
+// LastTick - время последнего тика, последнего успешного тика и ошибка последнего тика
+func (sc *StatsCollector) LastTick() (lastTick time.Time, lastSuccess time.Time, lastErr error) {
+	sc.health.mu.Lock()
+	defer sc.health.mu.Unlock()
+	return sc.health.lastTick, sc.health.lastSuccess, sc.health.lastErr
+}
+
+// InFlightSince - время начала выполняющегося сейчас тика или Init, нулевое если ничего не выполняется
+func (sc *StatsCollector) InFlightSince() time.Time {
+	sc.health.mu.Lock()
+	defer sc.health.mu.Unlock()
+	return sc.health.started
+}
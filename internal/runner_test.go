@@ -0,0 +1,85 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	postgresDownDsn   = "postgres://postgres@127.0.0.1:1/postgres?sslmode=disable&connect_timeout=1"
+	clickhouseDownDsn = "http://127.0.0.1:1/default"
+)
+
+func TestStatsCollector_Run_NotReady(t *testing.T) {
+	sc, err := NewStatsCollector(context.Background(), &PgStatStatementsFactory{}, "hostname", postgresDownDsn, clickhouseDownDsn, 60, CollectorOptions{
+		Backoff: Backoff{Min: 10 * time.Millisecond, Max: 10 * time.Millisecond},
+	})
+	assert.NoError(t, err, "collector should be created when postgres is down")
+	assert.False(t, sc.Ready(), "collector should not be ready when postgres is down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error)
+	go func() { done <- sc.Run(ctx, time.Second) }()
+
+	select {
+	case err = <-done:
+		assert.NoError(t, err, "stop before ready is not an error")
+	case <-time.After(5 * time.Second):
+		t.Error("Run is not stopped after ctx cancel")
+	}
+	assert.NoError(t, sc.Shutdown())
+}
+
+func TestNewStatsCollector_InitTimeout(t *testing.T) {
+	// postgres, который принимает соединение и молчит
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	hungDsn := "postgres://postgres@" + listener.Addr().String() + "/postgres?sslmode=disable"
+
+	start := time.Now()
+	sc, err := NewStatsCollector(context.Background(), &PgStatStatementsFactory{}, "hostname", hungDsn, clickhouseDownDsn, 60, CollectorOptions{
+		Timeout: 100 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second), "init should be bounded by the collector timeout")
+	assert.False(t, sc.Ready())
+	assert.True(t, sc.InFlightSince().IsZero(), "init is finished")
+	assert.NoError(t, sc.Shutdown())
+}
+
+func TestStatsCollector_Run_PreflightFailed(t *testing.T) {
+	sc, err := NewStatsCollector(context.Background(), &PgStatStatementsFactory{}, "hostname", postgresDownDsn, clickhouseDownDsn, 60, CollectorOptions{
+		Backoff:   Backoff{Min: 10 * time.Millisecond, Max: 10 * time.Millisecond},
+		Preflight: PreflightDisable,
+	})
+	assert.NoError(t, err)
+	sc.preflightErr = &PreflightError{Failed: []CheckResult{{Target: "postgres", Check: "extension pg_stat_statements", Err: errors.New("not satisfied")}}}
+
+	done := make(chan error)
+	go func() { done <- sc.Run(context.Background(), time.Second) }()
+
+	select {
+	case err = <-done:
+		var preflightErr *PreflightError
+		assert.True(t, errors.As(err, &preflightErr), "Run should return preflight error without retries")
+	case <-time.After(5 * time.Second):
+		t.Error("Run is not stopped after failed preflight")
+	}
+	assert.NoError(t, sc.Shutdown())
+}
@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshotFile - формат checkpoint-а снапшота на диске
+type snapshotFile struct {
+	Collector string            `json:"collector"`
+	Version   int64             `json:"version"`
+	Instance  *PgInstance       `json:"instance"`
+	Rows      []json.RawMessage `json:"rows"`
+}
+
+// saveSnapshot атомарно (через rename) пишет снапшот в path
+func saveSnapshot(path string, cf CollectorFactory, instance *PgInstance, snapshot *PgStatMetrics) error {
+	file := snapshotFile{
+		Collector: cf.Name(),
+		Version:   snapshot.version,
+		Instance:  instance,
+		Rows:      make([]json.RawMessage, 0, snapshot.len()),
+	}
+	fields := cf.emptyMetric().fields()
+	for i := 0; i < snapshot.len(); i++ {
+		snapshot.load(i, fields)
+		values := make([]interface{}, 0, len(fields))
+		for _, f := range fields {
+			switch v := f.(type) {
+			case *string:
+				values = append(values, *v)
+			case *float64:
+				values = append(values, *v)
+			default:
+				return fmt.Errorf("unsupported field type %T in %s", f, cf.Name())
+			}
+		}
+		row, err := json.Marshal(values)
+		if err != nil {
+			return err
+		}
+		file.Rows = append(file.Rows, row)
+	}
+
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadSnapshot читает checkpoint снапшота.
+// Возвращает nil без ошибки если файла нет, снапшот истек по ttl или снят с другого инстанса postgres.
+func loadSnapshot(path string, cf CollectorFactory, instance *PgInstance, ttl int64) (*PgStatMetrics, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file snapshotFile
+	if err = json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("corrupted snapshot %s: %w", path, err)
+	}
+	if file.Collector != cf.Name() {
+		return nil, nil
+	}
+	if time.Now().Unix()-file.Version > ttl {
+		return nil, nil
+	}
+	if !instance.equal(file.Instance) {
+		return nil, nil
+	}
+
+	metrics := newPgStatMetrics(len(file.Rows))
+	for i, row := range file.Rows {
+		metric := cf.emptyMetric()
+		fields := metric.fields()
+
+		var values []json.RawMessage
+		if err = json.Unmarshal(row, &values); err != nil {
+			return nil, fmt.Errorf("corrupted snapshot row %d: %w", i, err)
+		}
+		// структура метрики поменялась между версиями - такой снапшот не используем
+		if len(values) != len(fields) {
+			return nil, nil
+		}
+		for j, f := range fields {
+			if err = json.Unmarshal(values[j], f); err != nil {
+				return nil, fmt.Errorf("corrupted snapshot row %d: %w", i, err)
+			}
+		}
+		metrics.append(metric)
+	}
+	metrics.seal()
+	metrics.version = file.Version
+	return metrics, nil
+}
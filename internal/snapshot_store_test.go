@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func getMockSnapshot() *PgStatMetrics {
+	return snapshotOf(time.Now().Unix(), getDefaultMock())
+}
+
+func TestSnapshotStore_SaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "PgStatStatements.json")
+	instance := &PgInstance{SystemIdentifier: "6848765366523682847", StartTime: 1600000000}
+	given := getMockSnapshot()
+
+	assert.NoError(t, saveSnapshot(path, &PgStatStatementsFactory{}, instance, given), "error during save snapshot")
+
+	actual, err := loadSnapshot(path, &PgStatStatementsFactory{}, instance, 60)
+	assert.NoError(t, err, "error during load snapshot")
+	assert.Equal(t, given, actual, "loaded snapshot differs from saved")
+}
+
+func TestSnapshotStore_Load_NotExists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "PgStatStatements.json")
+
+	actual, err := loadSnapshot(path, &PgStatStatementsFactory{}, &PgInstance{}, 60)
+	assert.NoError(t, err, "missing snapshot is not an error")
+	assert.Nil(t, actual, "missing snapshot should not be loaded")
+}
+
+func TestSnapshotStore_Load_Expired(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "PgStatStatements.json")
+	instance := &PgInstance{SystemIdentifier: "6848765366523682847", StartTime: 1600000000}
+	given := getMockSnapshot()
+	given.version -= 120
+
+	assert.NoError(t, saveSnapshot(path, &PgStatStatementsFactory{}, instance, given), "error during save snapshot")
+
+	actual, err := loadSnapshot(path, &PgStatStatementsFactory{}, instance, 60)
+	assert.NoError(t, err, "expired snapshot is not an error")
+	assert.Nil(t, actual, "expired snapshot should not be loaded")
+}
+
+func TestSnapshotStore_Load_OtherInstance(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "PgStatStatements.json")
+	instance := &PgInstance{SystemIdentifier: "6848765366523682847", StartTime: 1600000000}
+	restarted := &PgInstance{SystemIdentifier: "6848765366523682847", StartTime: 1600000100}
+
+	assert.NoError(t, saveSnapshot(path, &PgStatStatementsFactory{}, instance, getMockSnapshot()), "error during save snapshot")
+
+	actual, err := loadSnapshot(path, &PgStatStatementsFactory{}, restarted, 60)
+	assert.NoError(t, err, "snapshot of other instance is not an error")
+	assert.Nil(t, actual, "snapshot of restarted instance should not be loaded")
+}
+
+func TestSnapshotStore_Load_OtherCollector(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	instance := &PgInstance{SystemIdentifier: "6848765366523682847", StartTime: 1600000000}
+
+	assert.NoError(t, saveSnapshot(path, &PgStatStatementsFactory{}, instance, getMockSnapshot()), "error during save snapshot")
+
+	actual, err := loadSnapshot(path, &PgTableSizeFactory{}, instance, 60)
+	assert.NoError(t, err, "snapshot of other collector is not an error")
+	assert.Nil(t, actual, "snapshot of other collector should not be loaded")
+}
+
+func TestSnapshotStore_Load_Corrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "PgStatStatements.json")
+	assert.NoError(t, os.WriteFile(path, []byte("{not json"), 0644))
+
+	_, err := loadSnapshot(path, &PgStatStatementsFactory{}, &PgInstance{}, 60)
+	assert.Error(t, err, "expected corrupted snapshot error")
+}
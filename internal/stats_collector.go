@@ -1,12 +1,17 @@
 package internal
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/stdlib"
 	_ "github.com/jackc/pgx/v4/stdlib"
 	_ "github.com/mailru/go-clickhouse"
+	"log/slog"
+	"strconv"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,15 +20,140 @@ var (
 	pgMaxIdleConns = 0 // disable pooling
 )
 
+const (
+	// defaultPushMaxRows - сколько дельт уходит в один INSERT потокового тика
+	defaultPushMaxRows = 10000
+	// defaultPushMaxBytes - примерный размер значений одного INSERT-а
+	defaultPushMaxBytes = 16 << 20
+	defaultPushRetries  = 2
+)
+
+// ErrCircuitOpen - endpoint недоступен, запросы к нему временно не выполняются
+var ErrCircuitOpen = errors.New("circuit is open")
+
+// PushError - часть пачек тика не вставилась и после повторов, остальные вставлены.
+// HTTP транзакция clickhouse все равно не атомарна, поэтому пачки независимы
+type PushError struct {
+	Batches       int
+	FailedBatches int
+	Rows          int
+	FailedRows    int
+	// Err - ошибка последней упавшей пачки
+	Err error
+}
+
+func (e *PushError) Error() string {
+	return fmt.Sprintf("%d of %d batches (%d of %d rows) are not inserted: %s", e.FailedBatches, e.Batches, e.FailedRows, e.Rows, e.Err)
+}
+
+func (e *PushError) Unwrap() error {
+	return e.Err
+}
+
 // StatsCollector - хранит последний state снапшота метрик и при отправке считает дельты по ней.
 //    не считает дельту и не отправляет метрики, снапшот истек по ttl
 type StatsCollector struct {
-	hostname string
-	cf       CollectorFactory
-	postgres *sql.DB
-	ch       *sql.DB
+	hostname     string
+	cf           CollectorFactory
+	postgres     *sql.DB
+	ch           *sql.DB
+	snapshot     *PgStatMetrics
+	ttl          int64
+	instance     *PgInstance
+	snapshotPath string
+	ready        int32
+	backoff      Backoff
+	pgBreaker    *circuitBreaker
+	chBreaker    *circuitBreaker
+	timeout      time.Duration
+
+	shutdownTimeout time.Duration
+	flushOnShutdown bool
+	health          tickHealth
+	restore         *restoredSnapshot
+	// pendingEvents - смены инстанса, не записанные в clickhouse, повторяются на следующих тиках
+	pendingEvents   []instanceEvent
+	logger          *slog.Logger
+	preflight       string
+	preflightPassed bool
+	preflightErr    error
+	addColumns      bool
+	tables          ClickhouseTables
+	labels          Labels
+	pushTable       string
+	pushColumns     []string
+	instanceName    string
+	pushMaxRows     int
+	pushMaxBytes    int
+	pushRetries     int
+	// plans - сэмплер планов top запросов, nil - выключен
+	plans *planSampler
+	// regressions - детектор регрессий времени запросов, nil - выключен; regressionWebhook - nil без вебхука
+	regressions       *regressionDetector
+	regressionWebhook *webhook
+	// alerts - правила ALERT_RULES коллектора, nil - правил нет; alertWebhook - nil без вебхука
+	alerts       *alertEvaluator
+	alertWebhook *webhook
+	alertFormat  string
+	dryRun       bool
+}
+
+// CollectorOptions - необязательные настройки StatsCollector, нулевые значения заменяются дефолтами
+type CollectorOptions struct {
+	// SnapshotPath - файл для checkpoint-а снапшота, пустая строка - не сохранять
+	SnapshotPath string
+	// Backoff - задержки между попытками подключения и время, на которое размыкается circuit breaker
+	Backoff Backoff
+	// BreakerThreshold - число ошибок подряд, после которого endpoint считается недоступным
+	BreakerThreshold int
+	// Timeout - deadline на весь тик: сбор, мерж и отправку
+	Timeout time.Duration
+	// StatementTimeout, LockTimeout - statement_timeout и lock_timeout сессии мониторинга в postgres
+	StatementTimeout time.Duration
+	LockTimeout      time.Duration
+	// ShutdownTimeout - сколько ждать текущий и последний тик при остановке
+	ShutdownTimeout time.Duration
+	// FlushOnShutdown - при остановке собрать и отправить неполный последний интервал
+	FlushOnShutdown bool
+	// DryRun - не ходить в clickhouse, а логировать строки, которые ушли бы в Push
+	DryRun bool
+	// Preflight - PreflightOff, PreflightDisable или PreflightFail, по умолчанию off
+	Preflight string
+	// AddColumns - на preflight добавить в таблицу clickhouse недостающие колонки как Nullable
+	AddColumns bool
+	// Tables - база и имена таблиц clickhouse, по умолчанию pg.<table>_buffer
+	Tables ClickhouseTables
+	// Labels - метки, которые дописываются к каждой строке метрик вместе с ролью инстанса
+	Labels Labels
+	// PushMaxRows, PushMaxBytes - ограничения одного INSERT-а, по умолчанию 10000 строк и 16 MiB (defaultPushMaxBytes из конфига).
+	// PushMaxBytes 0 - без ограничения по размеру
+	PushMaxRows  int
+	PushMaxBytes int
+	// PushRetries - сколько раз повторить INSERT упавшей пачки, 0 - не повторять. Работает только с дедупликацией, см. ClickhouseTables.pushRetries
+	PushRetries int
+	// PlanSampleTop - сколько запросов с наибольшей дельтой total_time за тик сэмплировать в pg_query_plans,
+	// только для PgStatStatements, 0 - выключено
+	PlanSampleTop int
+	// RegressionFactor - во сколько раз время на вызов за интервал должно превысить baseline, чтобы записать регрессию,
+	// только для PgStatStatements, 0 - выключено. RegressionMinCalls - интервалы с меньшим числом вызовов не сравниваются
+	RegressionFactor   float64
+	RegressionMinCalls int
+	// RegressionWebhook - URL, на который POST-ом уходят регрессии тика, пустой - только clickhouse и лог
+	RegressionWebhook string
+	// AlertRules - правила этого коллектора; сработавшее правило повторяется не чаще раза в AlertCooldown.
+	// AlertWebhook в формате AlertWebhookFormat, пустой - только лог
+	AlertRules         []AlertRule
+	AlertCooldown      time.Duration
+	AlertWebhook       string
+	AlertWebhookFormat string
+
+	// restore - снапшот остановленного коллектора того же типа, переиспользуется при reload-е
+	restore *restoredSnapshot
+}
+
+type restoredSnapshot struct {
 	snapshot *PgStatMetrics
-	ttl      int64
+	instance *PgInstance
 }
 
 // PgMetric метрики postgres-а с которым оперирует StatsCollector
@@ -32,34 +162,52 @@ type PgMetric interface {
 	delta(old PgMetric) PgMetric
 	getHash() uint32
 	getValue(hostname string) []interface{}
+	// fields - указатели на все поля метрики в фиксированном порядке, по ним снапшот сохраняется на диск
+	fields() []interface{}
+	// appendTo - значения fields() по порядку: строковые дописываются в strs, числовые в floats.
+	// Так снапшот пишет строку в колонки без reflect и аллокаций
+	appendTo(strs []string, floats []float64) ([]string, []float64)
 }
 
 // CollectorFactory читает метрики определенной структуры и ответственнен за sql запросы
 type CollectorFactory interface {
 	Name() string
-	CollectQuery() string
-	NewMetric(rows *sql.Rows) (PgMetric, error)
-	PushQuery() string
+	// CollectQuery - запрос сбора для server_version_num инстанса, 0 - версия еще неизвестна
+	CollectQuery(serverVersion int) string
+	NewMetric(ctx context.Context, rows *sql.Rows) (PgMetric, error)
+	// TableName - MergeTree таблица clickhouse без базы и префикса, Buffer к ней называется с суффиксом _buffer
+	TableName() string
+	// PushColumns - колонки clickhouse в порядке значений PgMetric.getValue
+	PushColumns() []string
+	emptyMetric() PgMetric
+	// prerequisites - что должно быть в postgres, чтобы CollectQuery отработал
+	prerequisites() []prerequisite
+	// gaugeColumns - колонки PushColumns с текущим значением, а не накопленным счетчиком.
+	// Правила ALERT_RULES только по ним проверяются и на строках без прошлого снапшота
+	gaugeColumns() []string
 }
 
-// PgStatMetrics - хранит метрики и hash map по ключам метрик для подсчета delta между отравками, version - время сбора
-type PgStatMetrics struct {
-	rows     []PgMetric
-	keysHash map[uint32]int
-	version  int64
-}
-
-func NewStatsCollector(collector CollectorFactory, hostname string, postgresDsn string, clickhouseDsn string, ttl int64) (*StatsCollector, error) {
-	connConfig, _ := pgx.ParseConfig(postgresDsn)
+// NewStatsCollector не падает если postgres или clickhouse недоступны: коллектор остается в состоянии not ready,
+// инициализация повторяется в WaitReady и Tick.
+// Если задан opts.SnapshotPath, начальный снапшот поднимается с диска,
+// при условии что он не истек по ttl и снят с того же инстанса postgres
+func NewStatsCollector(ctx context.Context, collector CollectorFactory, hostname string, postgresDsn string, clickhouseDsn string, ttl int64, opts CollectorOptions) (*StatsCollector, error) {
+	connConfig, err := pgx.ParseConfig(postgresDsn)
+	if err != nil {
+		return nil, fmt.Errorf("postgres dsn is invalid: %w", err)
+	}
 	connConfig.PreferSimpleProtocol = true
+	if opts.StatementTimeout > 0 {
+		connConfig.RuntimeParams["statement_timeout"] = strconv.FormatInt(opts.StatementTimeout.Milliseconds(), 10)
+	}
+	if opts.LockTimeout > 0 {
+		connConfig.RuntimeParams["lock_timeout"] = strconv.FormatInt(opts.LockTimeout.Milliseconds(), 10)
+	}
 	connStr := stdlib.RegisterConnConfig(connConfig)
 	postgres, err := sql.Open("pgx", connStr)
 	if err != nil {
 		return nil, fmt.Errorf("postgres conn failed with: %w", err)
 	}
-	if err = postgres.Ping(); err != nil {
-		return nil, fmt.Errorf("postgres ping failed with: %w", err)
-	}
 	postgres.SetMaxOpenConns(pgMaxOpenConns)
 	postgres.SetMaxIdleConns(pgMaxIdleConns)
 
@@ -67,97 +215,562 @@ func NewStatsCollector(collector CollectorFactory, hostname string, postgresDsn
 	if err != nil {
 		return nil, fmt.Errorf("clickhouse conn failed with: %w", err)
 	}
-	if err = ch.Ping(); err != nil {
-		return nil, fmt.Errorf("clickhouse ping failed with: %w", err)
+	if opts.Backoff.Jitter == 0 {
+		opts.Backoff.Jitter = defaultBackoffJitter
+	}
+	if opts.Backoff.Min == 0 {
+		opts.Backoff.Min = defaultBackoffMin
+	}
+	if opts.Backoff.Max == 0 {
+		opts.Backoff.Max = defaultBackoffMax
+	}
+	logger := slog.With("collector", collector.Name(), "instance", instanceName(connConfig))
+	if opts.ShutdownTimeout == 0 {
+		opts.ShutdownTimeout = defaultShutdownTimeout
+	}
+	if opts.Tables.Database == "" {
+		opts.Tables.Database = defaultClickhouseDatabase
+	}
+	if opts.Preflight == "" {
+		opts.Preflight = PreflightOff
+	}
+	if opts.PushMaxRows <= 0 {
+		opts.PushMaxRows = defaultPushMaxRows
 	}
 	sc := &StatsCollector{
-		cf:       collector,
-		hostname: hostname,
-		postgres: postgres,
-		ch:       ch,
-		ttl:      ttl,
+		cf:           collector,
+		hostname:     hostname,
+		postgres:     postgres,
+		ch:           ch,
+		ttl:          ttl,
+		snapshotPath: opts.SnapshotPath,
+		backoff:      opts.Backoff,
+		pgBreaker:    newCircuitBreaker(logger.With("endpoint", "postgres"), opts.BreakerThreshold, opts.Backoff),
+		chBreaker:    newCircuitBreaker(logger.With("endpoint", "clickhouse"), opts.BreakerThreshold, opts.Backoff),
+		timeout:      opts.Timeout,
+
+		shutdownTimeout: opts.ShutdownTimeout,
+		flushOnShutdown: opts.FlushOnShutdown,
+		restore:         opts.restore,
+		logger:          logger,
+		dryRun:          opts.DryRun,
+		preflight:       opts.Preflight,
+		addColumns:      opts.AddColumns,
+		tables:          opts.Tables,
+		labels:          opts.Labels,
+		pushTable:       opts.Tables.pushTable(collector),
+		pushColumns:     rowColumns(collector, opts.Labels),
+		instanceName:    instanceName(connConfig),
+		pushMaxRows:     opts.PushMaxRows,
+		pushMaxBytes:    opts.PushMaxBytes,
+		pushRetries:     opts.Tables.pushRetries(opts.PushRetries),
 	}
-	sc.snapshot, err = sc.Collect()
-	if err != nil {
-		return nil, fmt.Errorf("can't save initial stats snapshot: %w", err)
+	if opts.PushRetries > 0 && sc.pushRetries == 0 && !opts.DryRun {
+		logger.Warn("push retries are disabled, batches have no insert_deduplication_token: enable CLICKHOUSE_DIRECT_INSERT for the collector",
+			"push_retries", opts.PushRetries)
+	}
+	if _, ok := collector.(*PgStatStatementsFactory); ok && opts.PlanSampleTop > 0 {
+		sc.plans = newPlanSampler(opts.PlanSampleTop)
+	}
+	if _, ok := collector.(*PgStatStatementsFactory); ok && opts.RegressionFactor > 0 {
+		sc.regressions = newRegressionDetector(opts.RegressionFactor, opts.RegressionMinCalls)
+		if opts.RegressionWebhook != "" {
+			sc.regressionWebhook = newWebhook(opts.RegressionWebhook)
+		}
+	}
+	if len(opts.AlertRules) > 0 {
+		sc.alerts = newAlertEvaluator(collector, opts.AlertRules, opts.AlertCooldown)
+		sc.alertFormat = opts.AlertWebhookFormat
+		if opts.AlertWebhook != "" {
+			sc.alertWebhook = newWebhook(opts.AlertWebhook)
+		}
+	}
+	if err = sc.initBounded(ctx); err != nil {
+		logger.Warn("collector is not ready", "error", err)
 	}
 	return sc, nil
 }
 
-//Tick is main loop
-func (sc *StatsCollector) Tick() error {
-	newSnap, err := sc.Collect()
+// Ready - коллектор подключился к postgres и clickhouse и снял начальный снапшот
+func (sc *StatsCollector) Ready() bool {
+	return atomic.LoadInt32(&sc.ready) == 1
+}
+
+// initBounded - Init вне тика: ограничен timeout-ом коллектора, как тик, и виден liveness probe как выполняющийся
+func (sc *StatsCollector) initBounded(ctx context.Context) error {
+	if sc.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, sc.timeout)
+		defer cancel()
+	}
+	sc.health.start()
+	defer sc.health.finish()
+	return sc.Init(ctx)
+}
+
+// Init проверяет доступность postgres и clickhouse и снимает начальный снапшот
+func (sc *StatsCollector) Init(ctx context.Context) error {
+	if err := sc.postgres.PingContext(ctx); err != nil {
+		sc.pgBreaker.failure(err)
+		return fmt.Errorf("postgres ping failed with: %w", err)
+	}
+	if !sc.dryRun {
+		if err := sc.ch.PingContext(ctx); err != nil {
+			sc.chBreaker.failure(err)
+			return fmt.Errorf("clickhouse ping failed with: %w", err)
+		}
+		sc.chBreaker.success()
+	}
+	if err := sc.runPreflight(ctx); err != nil {
+		return err
+	}
+
+	instance, err := fetchInstance(ctx, sc.postgres)
 	if err != nil {
-		return fmt.Errorf("collect failed with: %w", err)
+		sc.pgBreaker.failure(err)
+		return fmt.Errorf("can't get postgres instance identity: %w", err)
+	}
+	sc.instance = instance
+	if restore := sc.restore; restore != nil {
+		sc.restore = nil
+		if restore.instance.equal(sc.instance) && time.Now().Unix()-restore.snapshot.version <= sc.ttl {
+			sc.pgBreaker.success()
+			sc.snapshot = restore.snapshot
+			atomic.StoreInt32(&sc.ready, 1)
+			return nil
+		}
+	}
+	if sc.snapshotPath != "" {
+		snapshot, err := loadSnapshot(sc.snapshotPath, sc.cf, sc.instance, sc.ttl)
+		if err != nil {
+			return fmt.Errorf("can't load stats snapshot: %w", err)
+		}
+		if snapshot != nil {
+			sc.pgBreaker.success()
+			sc.snapshot = snapshot
+			atomic.StoreInt32(&sc.ready, 1)
+			return nil
+		}
 	}
-	deltaMetrics, err := sc.Merge(newSnap)
+	snapshot, err := sc.Collect(ctx)
 	if err != nil {
-		return fmt.Errorf("merge failed with: %w", err)
+		sc.pgBreaker.failure(err)
+		return fmt.Errorf("can't save initial stats snapshot: %w", err)
 	}
-	err = sc.Push(deltaMetrics)
+	sc.pgBreaker.success()
+	sc.snapshot = snapshot
+	atomic.StoreInt32(&sc.ready, 1)
+	return nil
+}
+
+// WaitReady повторяет Init с экспоненциальным backoff-ом, пока коллектор не станет ready или не отменят ctx.
+// Если не прошел preflight, возвращает *PreflightError без повторов
+func (sc *StatsCollector) WaitReady(ctx context.Context) error {
+	for attempt := 0; !sc.Ready(); attempt++ {
+		if sc.preflightErr != nil {
+			return sc.preflightErr
+		}
+		wait := sc.backoff.Duration(attempt)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		if err := sc.initBounded(ctx); err != nil {
+			sc.logger.Warn("collector is not ready", "next_attempt_in", sc.backoff.Duration(attempt+1).Round(time.Second), "error", err)
+		}
+	}
+	return nil
+}
+
+// Tick is main loop. Вся работа тика ограничена timeout-ом коллектора и отменяется вместе с ctx
+func (sc *StatsCollector) Tick(ctx context.Context) error {
+	if sc.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, sc.timeout)
+		defer cancel()
+	}
+	if !sc.pgBreaker.allow() {
+		return fmt.Errorf("postgres: %w", ErrCircuitOpen)
+	}
+	if !sc.chBreaker.allow() {
+		return fmt.Errorf("clickhouse: %w", ErrCircuitOpen)
+	}
+	if !sc.Ready() {
+		if err := sc.Init(ctx); err != nil {
+			return fmt.Errorf("collector is not ready: %w", err)
+		}
+		return nil
+	}
+	if err := sc.flushInstanceEvents(ctx); err != nil {
+		return err
+	}
+	tickStart := time.Now()
+	instance, err := fetchInstance(ctx, sc.postgres)
 	if err != nil {
-		return fmt.Errorf("push failed: %w", err)
+		sc.pgBreaker.failure(err)
+		return fmt.Errorf("instance check failed with: %w", err)
+	}
+	if event := instance.changeEvent(sc.instance); event != "" {
+		// счетчики от другого или перезапущенного инстанса несравнимы со снапшотом, начинаем с нового.
+		// Запрос сбора берется по версии нового инстанса, при ошибке остается старый, чтобы событие повторилось
+		oldInstance := sc.instance
+		sc.instance = instance
+		newSnap, err := sc.Collect(ctx)
+		if err != nil {
+			sc.instance = oldInstance
+			sc.pgBreaker.failure(err)
+			return fmt.Errorf("collect failed with: %w", err)
+		}
+		sc.pgBreaker.success()
+		sc.snapshot = newSnap
+		sc.logger.Warn("postgres instance changed, snapshot is invalidated",
+			"event", event,
+			"system_identifier", instance.SystemIdentifier,
+			"start_time", instance.StartTime,
+			"in_recovery", instance.InRecovery,
+		)
+		sc.queueInstanceEvent(instanceEvent{event: event, old: oldInstance, new: instance})
+		if err = sc.flushInstanceEvents(ctx); err != nil {
+			return err
+		}
+		return fmt.Errorf("postgres instance changed (%s), snapshot is invalidated", event)
+	}
+	sc.instance = instance
+	if time.Now().Unix()-sc.snapshot.version > sc.ttl {
+		newSnap, err := sc.Collect(ctx)
+		if err != nil {
+			sc.pgBreaker.failure(err)
+			return fmt.Errorf("collect failed with: %w", err)
+		}
+		sc.pgBreaker.success()
+		sc.snapshot = newSnap
+		return fmt.Errorf("metrics snapshot ttl is expired")
+	}
+	collected, pushed, collectErr, pushErr := sc.streamMerge(ctx, func(fn func(PgMetric) error) error {
+		return sc.scan(ctx, fn)
+	}, sc.Push)
+	if collectErr != nil {
+		sc.pgBreaker.failure(collectErr)
+	} else {
+		sc.pgBreaker.success()
+	}
+	if pushErr != nil {
+		sc.chBreaker.failure(pushErr)
+	} else {
+		sc.chBreaker.success()
 	}
+	if sc.plans != nil && collectErr == nil {
+		if err := sc.samplePlans(ctx); err != nil {
+			sc.logger.Warn("plan sampling failed", "error", err)
+		}
+	}
+	if sc.regressions != nil {
+		if err := sc.pushRegressions(ctx, sc.regressions.end()); err != nil {
+			sc.logger.Warn("regression events are not delivered", "error", err)
+		}
+	}
+	if sc.alerts != nil {
+		if err := sc.pushAlerts(ctx); err != nil {
+			sc.logger.Warn("alerts are not delivered", "error", err)
+		}
+	}
+	if collectErr != nil || pushErr != nil {
+		return errors.Join(wrapErr("collect failed with", collectErr), wrapErr("push failed", pushErr))
+	}
+	if sc.snapshotPath != "" {
+		if err = saveSnapshot(sc.snapshotPath, sc.cf, sc.instance, sc.snapshot); err != nil {
+			return fmt.Errorf("snapshot checkpoint failed: %w", err)
+		}
+	}
+	sc.logger.Debug("tick done", "rows_collected", collected, "rows_pushed", pushed, "duration", time.Since(tickStart))
 	return nil
 }
 
-func (sc *StatsCollector) Collect() (*PgStatMetrics, error) {
-	rows, err := sc.postgres.Query(sc.cf.CollectQuery())
+// wrapErr - fmt.Errorf("msg: %w"), nil остается nil
+func wrapErr(msg string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%s: %w", msg, err)
+}
+
+// scan выполняет CollectQuery и отдает метрики в fn по одной, не накапливая их
+func (sc *StatsCollector) scan(ctx context.Context, fn func(metric PgMetric) error) error {
+	query := sc.cf.CollectQuery(sc.instance.serverVersion())
+	sc.logger.Debug("query", "phase", "collect", "sql", query)
+	rows, err := sc.postgres.QueryContext(ctx, query)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer rows.Close()
 
-	metrics := make([]PgMetric, 0)
-	keysHash := make(map[uint32]int)
-	i := 0
 	for rows.Next() {
-		metric, err := sc.cf.NewMetric(rows)
+		metric, err := sc.cf.NewMetric(ctx, rows)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if err = fn(metric); err != nil {
+			return err
 		}
-		metrics = append(metrics, metric)
-		keysHash[metric.getHash()] = i
-		i++
 	}
-	if err = rows.Err(); err != nil {
+	return rows.Err()
+}
+
+func (sc *StatsCollector) Collect(ctx context.Context) (*PgStatMetrics, error) {
+	capacity := 0
+	if sc.snapshot != nil {
+		capacity = sc.snapshot.len()
+	}
+	metrics := newPgStatMetrics(capacity)
+	err := sc.scan(ctx, func(metric PgMetric) error {
+		metrics.append(metric)
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
-	return &PgStatMetrics{
-		rows:     metrics,
-		version:  time.Now().Unix(),
-		keysHash: keysHash,
-	}, nil
+	metrics.seal()
+	metrics.version = time.Now().Unix()
+	return metrics, nil
 }
 
 /*
 	Допускается коллизия или data loss при вызовах pg_stat_statements_reset().
 	Сравнивается предыдущий снапшот и считается дельта при допустимом snapshot stale по ttl.
 */
-func (sc *StatsCollector) Merge(metrics *PgStatMetrics) ([]PgMetric, error) {
+func (sc *StatsCollector) Merge(ctx context.Context, metrics *PgStatMetrics) ([]PgMetric, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	if metrics.version-sc.snapshot.version > sc.ttl {
 		sc.snapshot = metrics
 		return nil, fmt.Errorf("metrics snapshot ttl is expired")
 	}
-	mergedRows := make([]PgMetric, 0, len(metrics.rows))
+	mergedRows := make([]PgMetric, 0, metrics.len())
 
-	for k, mIdx := range metrics.keysHash {
-		if sIdx, ok := sc.snapshot.keysHash[k]; ok {
+	// строки снапшотов читаются в две переиспользуемые метрики, новая аллоцируется только для отправки
+	current, old := sc.cf.emptyMetric(), sc.cf.emptyMetric()
+	currentFields, oldFields := current.fields(), old.fields()
+	for mIdx := 0; mIdx < metrics.len(); mIdx++ {
+		hash := metrics.hash(mIdx)
+		// при коллизии hash отправляется только последняя строка
+		if last, _ := metrics.lookup(hash); last != mIdx {
+			continue
+		}
+		if sIdx, ok := sc.snapshot.lookup(hash); ok {
+			metrics.load(mIdx, currentFields)
+			sc.snapshot.load(sIdx, oldFields)
 			// экономим на метриках, если не было вызовов не отправляем ничего
-			if metrics.rows[mIdx].isSkippable(sc.snapshot.rows[sIdx]) {
+			if current.isSkippable(old) {
 				continue
 			}
-			mergedRows = append(mergedRows, metrics.rows[mIdx].delta(sc.snapshot.rows[sIdx]))
+			mergedRows = append(mergedRows, current.delta(old))
 		} else {
-			mergedRows = append(mergedRows, metrics.rows[mIdx])
+			metric := sc.cf.emptyMetric()
+			metrics.load(mIdx, metric.fields())
+			mergedRows = append(mergedRows, metric)
 		}
 	}
 	sc.snapshot = metrics
 	return mergedRows, nil
 }
 
-func (sc *StatsCollector) Push(metrics []PgMetric) error {
-	tx, err := sc.ch.Begin()
+// streamMerge - потоковый тик: строки из scan сразу сравниваются со снапшотом, а дельты уходят в push пачками
+// не больше pushMaxRows строк и pushMaxBytes байт. Пачки вставляет отдельная горутина, скан ждет ее, только когда
+// в очереди pushQueueBatches пачек. В памяти старый и новый компактные снапшоты, очередь и упавшие пачки.
+// Упавшие пачки повторяются pushRetries раз уже после скана: пока открыт курсор postgres, backoff не ждем,
+// иначе проблемы clickhouse держат снапшот транзакции в postgres и валят сбор по STATEMENT_TIMEOUT.
+// Пачка, которая так и не вставилась, пропускается, остальные вставляются, итог - *PushError.
+// Снапшот заменяется в любом случае, иначе дельты уже отправленных пачек задвоятся на следующем тике.
+// Если оборвался скан, недочитанные строки берутся из старого снапшота.
+// В отличие от Merge при коллизии hash отправляются обе строки
+func (sc *StatsCollector) streamMerge(ctx context.Context, scan func(fn func(PgMetric) error) error, push func(ctx context.Context, batch []PgMetric, token string) error) (collected int, pushed int, collectErr error, pushErr error) {
+	next := newPgStatMetrics(sc.snapshot.len())
+	next.version = time.Now().Unix()
+	old := sc.cf.emptyMetric()
+	oldFields := old.fields()
+	// метки и hostname одинаковы для всех строк, считаются один раз
+	labelBytes := valuesBytes(sc.labels.withInstance(sc.instance).values()) + len(sc.hostname)
+	if sc.plans != nil {
+		sc.plans.reset()
+	}
+	if sc.regressions != nil {
+		sc.regressions.begin()
+	}
+	if sc.alerts != nil {
+		sc.alerts.begin()
+	}
+	// часы между снапшотами для rate() правил ALERT_RULES
+	hours := float64(next.version-sc.snapshot.version) / 3600
+	batch := make([]PgMetric, 0, sc.pushMaxRows)
+	batchBytes := 0
+	result := PushError{}
+	queue := make(chan pendingBatch, pushQueueBatches)
+	var failed []pendingBatch
+	pushDone := make(chan struct{})
+	go func() {
+		defer close(pushDone)
+		for b := range queue {
+			if b.err = sc.pushBatch(ctx, push, b, 0); b.err != nil {
+				failed = append(failed, b)
+				continue
+			}
+			pushed += len(b.rows)
+		}
+	}()
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		result.Batches++
+		result.Rows += len(batch)
+		queue <- pendingBatch{rows: batch, token: sc.deduplicationToken(next.version, result.Batches)}
+		batch, batchBytes = make([]PgMetric, 0, sc.pushMaxRows), 0
+	}
+
+	collectErr = scan(func(metric PgMetric) error {
+		next.append(metric)
+		collected++
+		if sIdx, ok := sc.snapshot.lookup(metric.getHash()); ok {
+			sc.snapshot.load(sIdx, oldFields)
+			// экономим на метриках, если не было вызовов не отправляем ничего
+			if metric.isSkippable(old) {
+				if sc.alerts != nil {
+					sc.alerts.observe(nil, metric, nil, 0)
+				}
+				return nil
+			}
+			current := metric
+			metric = metric.delta(old)
+			// с новыми запросами сравнивать нечего, их значения накоплены не за интервал,
+			// по той же причине они не попадают в top планов
+			if sc.regressions != nil {
+				sc.regressions.observe(metric)
+			}
+			if sc.plans != nil {
+				sc.plans.observe(metric)
+			}
+			if sc.alerts != nil {
+				sc.alerts.observe(metric, current, old, hours)
+			}
+		} else if sc.alerts != nil {
+			// у новой строки нет дельты, но gauge правила по ее текущим значениям проверить можно
+			sc.alerts.observe(nil, metric, nil, 0)
+		}
+		rowBytes := labelBytes
+		if sc.pushMaxBytes > 0 {
+			rowBytes += valuesBytes(metric.getValue(""))
+			if len(batch) > 0 && batchBytes+rowBytes > sc.pushMaxBytes {
+				flush()
+			}
+		}
+		batch = append(batch, metric)
+		batchBytes += rowBytes
+		if len(batch) >= sc.pushMaxRows {
+			flush()
+		}
+		return nil
+	})
+	flush()
+	close(queue)
+	<-pushDone
+	// курсор уже закрыт, теперь можно ждать backoff между повторами
+	for _, b := range failed {
+		if err := sc.retryBatch(ctx, push, b); err != nil {
+			result.FailedBatches++
+			result.FailedRows += len(b.rows)
+			result.Err = err
+		} else {
+			pushed += len(b.rows)
+		}
+	}
+
+	if collectErr != nil {
+		next = next.withRest(sc.snapshot, sc.cf)
+	} else {
+		next.seal()
+	}
+	sc.snapshot = next
+	if result.FailedBatches > 0 {
+		pushErr = &result
+	}
+	return collected, pushed, collectErr, pushErr
+}
+
+// pushQueueBatches - сколько готовых пачек может ждать INSERT-а, пока скан читает следующие
+const pushQueueBatches = 2
+
+// pendingBatch - пачка тика с insert_deduplication_token и ошибкой последней попытки
+type pendingBatch struct {
+	rows  []PgMetric
+	token string
+	err   error
+}
+
+// pushBatch - одна попытка INSERT-а пачки
+func (sc *StatsCollector) pushBatch(ctx context.Context, push func(ctx context.Context, batch []PgMetric, token string) error, b pendingBatch, attempt int) error {
+	phaseStart := time.Now()
+	if err := push(ctx, b.rows, b.token); err != nil {
+		return err
+	}
+	sc.logger.Debug("phase done", "phase", "push", "rows", len(b.rows), "attempt", attempt, "duration", time.Since(phaseStart))
+	return nil
+}
+
+// retryBatch - pushRetries повторов упавшей пачки через backoff, пока не отменен ctx.
+// Все попытки идут с одним token: если clickhouse принял пачку, но ответ не дошел, повтор будет отброшен
+func (sc *StatsCollector) retryBatch(ctx context.Context, push func(ctx context.Context, batch []PgMetric, token string) error, b pendingBatch) error {
+	err := b.err
+	attempt := 1
+	for ; attempt <= sc.pushRetries && ctx.Err() == nil; attempt++ {
+		wait := sc.backoff.Duration(attempt - 1)
+		sc.logger.Warn("batch insert failed, retrying", "rows", len(b.rows), "next_attempt_in", wait.Round(time.Millisecond), "error", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		if err = sc.pushBatch(ctx, push, b, attempt); err == nil {
+			return nil
+		}
+	}
+	sc.logger.Warn("batch is not inserted", "rows", len(b.rows), "attempts", attempt, "error", err)
+	return err
+}
+
+// deduplicationToken - insert_deduplication_token пачки batch тика version, пустой без дедупликации.
+// Зависит только от коллектора, instance и номера пачки в снапшоте, поэтому совпадает у всех попыток INSERT-а
+func (sc *StatsCollector) deduplicationToken(version int64, batch int) string {
+	if !sc.tables.insertDeduplication() {
+		return ""
+	}
+	return fmt.Sprintf("%s:%s:%s:%d:%d", sc.cf.Name(), sc.hostname, sc.instanceName, version, batch)
+}
+
+// valuesBytes - примерный размер значений строки в теле INSERT-а: строки как есть, числа по 8 байт
+func valuesBytes(values []interface{}) int {
+	size := 0
+	for _, v := range values {
+		switch v := v.(type) {
+		case string:
+			size += len(v)
+		case *string:
+			size += len(*v)
+		default:
+			size += 8
+		}
+	}
+	return size
+}
+
+// Push - INSERT метрик одной транзакцией драйвера, то есть одним HTTP запросом. token - insert_deduplication_token, пустой - без него
+func (sc *StatsCollector) Push(ctx context.Context, metrics []PgMetric, token string) error {
+	if sc.dryRun {
+		sc.logDryRun(metrics)
+		return nil
+	}
+	tx, err := sc.ch.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
@@ -170,15 +783,19 @@ func (sc *StatsCollector) Push(metrics []PgMetric) error {
 		}
 	}()
 
-	stmt, err := tx.Prepare(sc.cf.PushQuery())
+	query := insertQuery(sc.pushTable, sc.pushColumns, token)
+	sc.logger.Debug("query", "phase", "push", "sql", query)
+	stmt, err := tx.PrepareContext(ctx, query)
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
+	labels := sc.labels.withInstance(sc.instance)
 	for _, metric := range metrics {
-		if _, err := stmt.Exec(
-			metric.getValue(sc.hostname)...,
+		if _, err := stmt.ExecContext(
+			ctx,
+			rowValues(metric, sc.hostname, labels)...,
 		); err != nil {
 			return err
 		}
@@ -191,6 +808,85 @@ func (sc *StatsCollector) Push(metrics []PgMetric) error {
 	return nil
 }
 
+// insertRows - INSERT n строк одним запросом, как Push, для небольших служебных таблиц
+func (sc *StatsCollector) insertRows(ctx context.Context, table string, columns []string, n int, row func(i int) []interface{}) error {
+	tx, err := sc.ch.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, insertQuery(table, columns, ""))
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for i := 0; i < n; i++ {
+		if _, err = stmt.ExecContext(ctx, row(i)...); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("row %d: %w", i, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// queueInstanceEvent - откладывает событие до успешной записи, снапшот к этому моменту уже переключен
+func (sc *StatsCollector) queueInstanceEvent(e instanceEvent) {
+	if len(sc.pendingEvents) >= maxPendingInstanceEvents {
+		dropped := sc.pendingEvents[0]
+		sc.logger.Warn("too many pending instance events, dropping the oldest", "event", dropped.event)
+		sc.pendingEvents = sc.pendingEvents[1:]
+	}
+	sc.pendingEvents = append(sc.pendingEvents, e)
+}
+
+func (sc *StatsCollector) flushInstanceEvents(ctx context.Context) error {
+	if len(sc.pendingEvents) == 0 {
+		return nil
+	}
+	pending, err := flushInstanceEvents(sc.pendingEvents, func(e instanceEvent) error {
+		return sc.pushInstanceEvent(ctx, e)
+	})
+	sc.pendingEvents = pending
+	if err != nil {
+		sc.chBreaker.failure(err)
+	}
+	return err
+}
+
+func (sc *StatsCollector) pushInstanceEvent(ctx context.Context, e instanceEvent) error {
+	if sc.dryRun {
+		return nil
+	}
+	_, err := sc.ch.ExecContext(
+		ctx,
+		instanceEventQuery(sc.tables.instanceEventsTable()),
+		sc.hostname,
+		sc.cf.Name(),
+		e.event,
+		e.old.SystemIdentifier,
+		e.new.SystemIdentifier,
+		e.old.StartTime,
+		e.new.StartTime,
+		boolToUInt8(e.old.InRecovery),
+		boolToUInt8(e.new.InRecovery),
+	)
+	return err
+}
+
+func (sc *StatsCollector) logDryRun(metrics []PgMetric) {
+	labels := sc.labels.withInstance(sc.instance)
+	columns := rowColumns(sc.cf, labels)
+	for _, metric := range metrics {
+		values := rowValues(metric, sc.hostname, labels)
+		attrs := make([]interface{}, 0, 2*len(values)+2)
+		attrs = append(attrs, "phase", "push")
+		for i, v := range values {
+			attrs = append(attrs, columns[i], plainValue(v))
+		}
+		sc.logger.Info("dry-run row", attrs...)
+	}
+}
+
 func (sc *StatsCollector) Shutdown() error {
 	if err := sc.postgres.Close(); err != nil {
 		return fmt.Errorf("error closing postgres: %w", err)
@@ -1,7 +1,12 @@
 package internal
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -19,6 +24,9 @@ func getDefaultMock() PgMetric {
 		query:               "select 1",
 		calls:               1,
 		total_time:          2,
+		min_time:            2,
+		max_time:            2,
+		mean_time:           2,
 		rows:                3,
 		shared_blks_hit:     4,
 		shared_blks_read:    5,
@@ -44,13 +52,13 @@ func getDefaultMockSlice() []PgMetric {
 func TestStatsCollector_Collect(t *testing.T) {
 	var givenHostname = "hostname"
 
-	sc, err := NewStatsCollector(&PgStatStatementsFactory{}, givenHostname, postgresDockerDsn, clickhouseDockerDsn, 60)
+	sc, err := NewStatsCollector(context.Background(), &PgStatStatementsFactory{}, givenHostname, postgresDockerDsn, clickhouseDockerDsn, 60, CollectorOptions{})
 	assert.Empty(t, err, "error init collector")
 
 	assert.Equal(t, givenHostname, sc.hostname, "hostname is not initiated")
 
 	excepted := getDefaultMockSlice()
-	assert.Equal(t, excepted, sc.snapshot.rows, "Wrong snapshot is initiated")
+	assert.Equal(t, excepted, sc.snapshot.metrics(sc.cf), "Wrong snapshot is initiated")
 
 	// put mock snapshot
 	mock := make([]PgMetric, 0, 1)
@@ -76,24 +84,24 @@ func TestStatsCollector_Collect(t *testing.T) {
 			blk_read_time:       0,
 			blk_write_time:      0,
 		})
-	sc.snapshot.rows = mock
+	sc.snapshot = snapshotOf(sc.snapshot.version, mock...)
 
-	metrics, err := sc.Collect()
+	metrics, err := sc.Collect(context.Background())
 	if err != nil {
 		t.Error(err.Error())
 		return
 	}
 
-	assert.Equal(t, excepted, metrics.rows, "Wrong data collected")
+	assert.Equal(t, excepted, metrics.metrics(sc.cf), "Wrong data collected")
 }
 
 func TestStatsCollector_Push(t *testing.T) {
-	sc, err := NewStatsCollector(&PgStatStatementsFactory{}, "hostname", postgresDockerDsn, clickhouseDockerDsn, 60)
+	sc, err := NewStatsCollector(context.Background(), &PgStatStatementsFactory{}, "hostname", postgresDockerDsn, clickhouseDockerDsn, 60, CollectorOptions{})
 	assert.Empty(t, err, "error init collector")
 
 	given := getDefaultMockSlice()
 
-	assert.NoError(t, sc.Push(given), "error during push metrics")
+	assert.NoError(t, sc.Push(context.Background(), given, ""), "error during push metrics")
 }
 
 func TestStatsCollector_Delta(t *testing.T) {
@@ -104,6 +112,9 @@ func TestStatsCollector_Delta(t *testing.T) {
 		query:               "select 1",
 		calls:               2,
 		total_time:          4,
+		min_time:            2,
+		max_time:            2,
+		mean_time:           2,
 		rows:                6,
 		shared_blks_hit:     8,
 		shared_blks_read:    10,
@@ -160,7 +171,7 @@ func TestStatsCollector_Merge_StaleErr(t *testing.T) {
 	var givenTtl = int64(60)
 	var tooHighInterval = int64(givenTtl * 2)
 
-	sc, err := NewStatsCollector(&PgStatStatementsFactory{}, "hostname", postgresDockerDsn, clickhouseDockerDsn, givenTtl)
+	sc, err := NewStatsCollector(context.Background(), &PgStatStatementsFactory{}, "hostname", postgresDockerDsn, clickhouseDockerDsn, givenTtl, CollectorOptions{})
 	assert.Empty(t, err, "error init collector")
 
 	mock := make([]PgMetric, 0, 1)
@@ -187,22 +198,15 @@ func TestStatsCollector_Merge_StaleErr(t *testing.T) {
 	}
 	mock = append(mock, newSnap)
 
-	hash := newSnap.getHash()
-	newState := &PgStatMetrics{
-		rows:    mock,
-		version: time.Now().Unix() + tooHighInterval,
-		keysHash: map[uint32]int{
-			hash: 0,
-		},
-	}
+	newState := snapshotOf(time.Now().Unix()+tooHighInterval, mock...)
 
-	_, err = sc.Merge(newState)
+	_, err = sc.Merge(context.Background(), newState)
 	assert.NotEmpty(t, err, "expected snapshot stale error")
-	assert.Equal(t, mock, sc.snapshot.rows, "expected new snapshot rows")
+	assert.Equal(t, mock, sc.snapshot.metrics(sc.cf), "expected new snapshot rows")
 }
 
 func TestStatsCollector_Merge_Delta(t *testing.T) {
-	sc, err := NewStatsCollector(&PgStatStatementsFactory{}, "hostname", postgresDockerDsn, clickhouseDockerDsn, 60)
+	sc, err := NewStatsCollector(context.Background(), &PgStatStatementsFactory{}, "hostname", postgresDockerDsn, clickhouseDockerDsn, 60, CollectorOptions{})
 	assert.Empty(t, err, "error init collector")
 
 	mock := make([]PgMetric, 0, 1)
@@ -229,23 +233,16 @@ func TestStatsCollector_Merge_Delta(t *testing.T) {
 	}
 	mock = append(mock, newSnap)
 
-	hash := newSnap.getHash()
-	newState := &PgStatMetrics{
-		rows:    mock,
-		version: time.Now().Unix(),
-		keysHash: map[uint32]int{
-			hash: 0,
-		},
-	}
+	newState := snapshotOf(time.Now().Unix(), mock...)
 
 	excepted := getDefaultMockSlice()
-	actual, err := sc.Merge(newState)
+	actual, err := sc.Merge(context.Background(), newState)
 	assert.Empty(t, err, "should be ok, because version is set to Now()")
 	assert.Equal(t, excepted, actual, "wrong merge")
 }
 
 func TestStatsCollector_Merge_Delta_Complicated(t *testing.T) {
-	sc, err := NewStatsCollector(&PgStatStatementsFactory{}, "hostname", postgresDockerDsn, clickhouseDockerDsn, 60)
+	sc, err := NewStatsCollector(context.Background(), &PgStatStatementsFactory{}, "hostname", postgresDockerDsn, clickhouseDockerDsn, 60, CollectorOptions{})
 	assert.Empty(t, err, "error init collector")
 
 	//в старый snapshot подсовываем метрику с queryid = 666 которого не будет в новом снапшоте
@@ -253,8 +250,9 @@ func TestStatsCollector_Merge_Delta_Complicated(t *testing.T) {
 	staleMetric := metric.(*PgStatStatement)
 	staleMetric.queryid = 666
 	hashStale := staleMetric.getHash()
-	sc.snapshot.rows = append(sc.snapshot.rows, staleMetric)
-	sc.snapshot.keysHash[hashStale] = len(sc.snapshot.rows) - 1
+	sc.snapshot = snapshotOf(sc.snapshot.version, append(sc.snapshot.metrics(sc.cf), staleMetric)...)
+	_, ok := sc.snapshot.lookup(hashStale)
+	assert.True(t, ok, "stale metric is not in the snapshot")
 
 	//в новый snapshot создаем пару для существующей метрики queryid = 0, и новую метрику c queryid = 123
 	mock := make([]PgMetric, 0, 1)
@@ -284,16 +282,7 @@ func TestStatsCollector_Merge_Delta_Complicated(t *testing.T) {
 	secondSnap.queryid = 123
 	mock = append(mock, newSnap, secondSnap)
 
-	hashFirst := newSnap.getHash()
-	hashSecond := secondSnap.getHash()
-	newState := &PgStatMetrics{
-		rows:    mock,
-		version: time.Now().Unix(),
-		keysHash: map[uint32]int{
-			hashFirst:  0,
-			hashSecond: 1,
-		},
-	}
+	newState := snapshotOf(time.Now().Unix(), mock...)
 
 	excepted := getDefaultMockSlice()
 	oneMore := getDefaultMock()
@@ -301,25 +290,189 @@ func TestStatsCollector_Merge_Delta_Complicated(t *testing.T) {
 	oneMoreExpected.queryid = 123
 	excepted = append(excepted, oneMoreExpected)
 
-	actual, err := sc.Merge(newState)
+	actual, err := sc.Merge(context.Background(), newState)
 	assert.Empty(t, err, "should be ok, because version is set to Now()")
 	assert.ElementsMatch(t, excepted, actual, "wrong merge")
 }
 
 func TestStatsCollector_Merge_Delta_Skippable(t *testing.T) {
-	sc, err := NewStatsCollector(&PgStatStatementsFactory{}, "hostname", postgresDockerDsn, clickhouseDockerDsn, 60)
+	sc, err := NewStatsCollector(context.Background(), &PgStatStatementsFactory{}, "hostname", postgresDockerDsn, clickhouseDockerDsn, 60, CollectorOptions{})
 	assert.Empty(t, err, "error init collector")
 
 	// подсовываем такую метрику как и в init
-	metrics := getDefaultMockSlice()
-	newState := &PgStatMetrics{
-		rows:    getDefaultMockSlice(),
-		version: time.Now().Unix(),
-		keysHash: map[uint32]int{
-			metrics[0].getHash(): 0,
-		},
-	}
-	actual, err := sc.Merge(newState)
+	newState := snapshotOf(time.Now().Unix(), getDefaultMockSlice()...)
+	actual, err := sc.Merge(context.Background(), newState)
 	assert.Empty(t, err, "error is not expected here")
 	assert.Empty(t, actual, "metric must be skipped")
 }
+
+func TestCollectorFactory_PushColumns(t *testing.T) {
+	for _, f := range []CollectorFactory{&PgStatStatementsFactory{}, &PgStatioTableFactory{}, &PgTableSizeFactory{}} {
+		assert.Len(t, f.emptyMetric().getValue("hostname"), len(f.PushColumns()), "%s: columns and values mismatch", f.Name())
+	}
+}
+
+func tableSizes(from int, to int, size float64) []PgMetric {
+	var metrics []PgMetric
+	for i := from; i < to; i++ {
+		metrics = append(metrics, &PgTableSize{datname: "postgres", schemaname: "public", tablename: fmt.Sprintf("t%d", i), size: size})
+	}
+	return metrics
+}
+
+func scanOf(metrics []PgMetric, err error) func(fn func(PgMetric) error) error {
+	return func(fn func(PgMetric) error) error {
+		for _, metric := range metrics {
+			if err := fn(metric); err != nil {
+				return err
+			}
+		}
+		return err
+	}
+}
+
+func TestStreamMerge_Batches(t *testing.T) {
+	sc := &StatsCollector{cf: &PgTableSizeFactory{}, logger: slog.Default(), pushMaxRows: 10, snapshot: snapshotOf(1, tableSizes(0, 5, 1)...)}
+	var batches []int
+	push := func(ctx context.Context, batch []PgMetric, token string) error {
+		batches = append(batches, len(batch))
+		return nil
+	}
+
+	collected, pushed, collectErr, pushErr := sc.streamMerge(context.Background(), scanOf(tableSizes(0, 25, 2), nil), push)
+	assert.NoError(t, collectErr)
+	assert.NoError(t, pushErr)
+	assert.Equal(t, 25, collected)
+	assert.Equal(t, 25, pushed)
+	assert.Equal(t, []int{10, 10, 5}, batches)
+	assert.Equal(t, tableSizes(0, 25, 2), sc.snapshot.metrics(sc.cf), "snapshot is replaced by scanned rows")
+}
+
+func TestStreamMerge_PushFailed(t *testing.T) {
+	sc := &StatsCollector{cf: &PgTableSizeFactory{}, logger: slog.Default(), pushMaxRows: 10, snapshot: snapshotOf(1)}
+	calls := 0
+	push := func(ctx context.Context, batch []PgMetric, token string) error {
+		calls++
+		if calls == 2 {
+			return errors.New("clickhouse is down")
+		}
+		return nil
+	}
+
+	collected, pushed, collectErr, err := sc.streamMerge(context.Background(), scanOf(tableSizes(0, 25, 2), nil), push)
+	assert.NoError(t, collectErr)
+	var pushErr *PushError
+	if assert.True(t, errors.As(err, &pushErr), "expected *PushError") {
+		assert.Equal(t, PushError{Batches: 3, FailedBatches: 1, Rows: 25, FailedRows: 10, Err: errors.New("clickhouse is down")}, *pushErr)
+		assert.Equal(t, "1 of 3 batches (10 of 25 rows) are not inserted: clickhouse is down", pushErr.Error())
+	}
+	assert.Equal(t, 3, calls, "batches after the failed one are pushed")
+	assert.Equal(t, 25, collected)
+	assert.Equal(t, 15, pushed)
+	assert.Equal(t, 25, sc.snapshot.len(), "snapshot is replaced to not push the inserted deltas twice")
+}
+
+func TestStreamMerge_Retry(t *testing.T) {
+	sc := &StatsCollector{cf: &PgTableSizeFactory{}, logger: slog.Default(), pushMaxRows: 10, pushRetries: 2, backoff: Backoff{Min: time.Millisecond}, snapshot: snapshotOf(1)}
+	calls := 0
+	push := func(ctx context.Context, batch []PgMetric, token string) error {
+		calls++
+		if calls <= 2 {
+			return errors.New("timeout")
+		}
+		return nil
+	}
+
+	_, pushed, _, pushErr := sc.streamMerge(context.Background(), scanOf(tableSizes(0, 5, 2), nil), push)
+	assert.NoError(t, pushErr)
+	assert.Equal(t, 3, calls, "2 retries")
+	assert.Equal(t, 5, pushed)
+
+	calls = -10
+	_, pushed, _, pushErr = sc.streamMerge(context.Background(), scanOf(tableSizes(0, 5, 2), nil), push)
+	assert.Error(t, pushErr, "retries are exhausted")
+	assert.Equal(t, -7, calls)
+	assert.Equal(t, 0, pushed)
+}
+
+func TestStreamMerge_RetryAfterScan(t *testing.T) {
+	sc := &StatsCollector{cf: &PgTableSizeFactory{}, logger: slog.Default(), pushMaxRows: 10, pushRetries: 1, backoff: Backoff{Min: time.Millisecond}, snapshot: snapshotOf(1)}
+	var scanDone int32
+	scan := func(fn func(PgMetric) error) error {
+		defer atomic.StoreInt32(&scanDone, 1)
+		return scanOf(tableSizes(0, 25, 2), nil)(fn)
+	}
+	var attempts []bool
+	push := func(ctx context.Context, batch []PgMetric, token string) error {
+		attempts = append(attempts, atomic.LoadInt32(&scanDone) == 1)
+		if len(attempts) == 1 {
+			return errors.New("timeout")
+		}
+		return nil
+	}
+
+	_, pushed, _, pushErr := sc.streamMerge(context.Background(), scan, push)
+	assert.NoError(t, pushErr)
+	assert.Equal(t, 25, pushed)
+	if assert.Len(t, attempts, 4) {
+		assert.True(t, attempts[3], "the failed batch is retried when the cursor is closed")
+	}
+}
+
+func TestStreamMerge_DeduplicationToken(t *testing.T) {
+	sc := &StatsCollector{cf: &PgTableSizeFactory{}, logger: slog.Default(), hostname: "pod-1", instanceName: "db:5432/postgres",
+		tables: ClickhouseTables{Direct: true, Deduplicate: true}, pushMaxRows: 10, pushRetries: 1, backoff: Backoff{Min: time.Millisecond}, snapshot: snapshotOf(1)}
+	var tokens []string
+	push := func(ctx context.Context, batch []PgMetric, token string) error {
+		tokens = append(tokens, token)
+		if len(tokens) == 2 {
+			return errors.New("timeout")
+		}
+		return nil
+	}
+
+	_, _, _, pushErr := sc.streamMerge(context.Background(), scanOf(tableSizes(0, 15, 2), nil), push)
+	assert.NoError(t, pushErr)
+	version := sc.snapshot.version
+	assert.Equal(t, []string{
+		fmt.Sprintf("PgTableSize:pod-1:db:5432/postgres:%d:1", version),
+		fmt.Sprintf("PgTableSize:pod-1:db:5432/postgres:%d:2", version),
+		fmt.Sprintf("PgTableSize:pod-1:db:5432/postgres:%d:2", version),
+	}, tokens, "retry of the batch has the same token")
+
+	tokens = nil
+	sc.tables.Direct = false
+	sc.streamMerge(context.Background(), scanOf(tableSizes(0, 5, 3), nil), push)
+	assert.Equal(t, []string{""}, tokens, "Buffer table doesn't deduplicate")
+}
+
+func TestStreamMerge_MaxBytes(t *testing.T) {
+	row := valuesBytes(tableSizes(0, 1, 2)[0].getValue("")) + len("hostname") + len("primary")
+	sc := &StatsCollector{cf: &PgTableSizeFactory{}, logger: slog.Default(), hostname: "hostname", instance: &PgInstance{},
+		pushMaxRows: 100, pushMaxBytes: 3 * row, snapshot: snapshotOf(1)}
+	var batches []int
+	push := func(ctx context.Context, batch []PgMetric, token string) error {
+		batches = append(batches, len(batch))
+		return nil
+	}
+
+	_, pushed, _, pushErr := sc.streamMerge(context.Background(), scanOf(tableSizes(0, 8, 2), nil), push)
+	assert.NoError(t, pushErr)
+	assert.Equal(t, 8, pushed)
+	assert.Equal(t, []int{3, 3, 2}, batches)
+}
+
+func TestStreamMerge_ScanFailed(t *testing.T) {
+	sc := &StatsCollector{cf: &PgTableSizeFactory{}, logger: slog.Default(), pushMaxRows: 10, snapshot: snapshotOf(1, tableSizes(0, 20, 1)...)}
+	pushed := 0
+	push := func(ctx context.Context, batch []PgMetric, token string) error {
+		pushed += len(batch)
+		return nil
+	}
+
+	_, _, collectErr, pushErr := sc.streamMerge(context.Background(), scanOf(tableSizes(0, 15, 2), errors.New("canceling statement due to statement timeout")), push)
+	assert.Error(t, collectErr)
+	assert.NoError(t, pushErr)
+	assert.Equal(t, 15, pushed, "merged rows are pushed before the error")
+	assert.Equal(t, append(tableSizes(0, 15, 2), tableSizes(15, 20, 1)...), sc.snapshot.metrics(sc.cf), "rows which were not scanned keep the old baseline")
+}
@@ -0,0 +1,450 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	StateStarting   = "starting"
+	StateNotReady   = "not ready"
+	StateRunning    = "running"
+	StateRestarting = "restarting"
+	StateStopped    = "stopped"
+	// StateDisabled - коллектор не прошел preflight и выключен до reload-а
+	StateDisabled = "disabled"
+)
+
+// CollectorSpec - какой коллектор, с какой периодичностью, из какого postgres собирать и в какие таблицы писать
+type CollectorSpec struct {
+	Factory     CollectorFactory
+	Interval    time.Duration
+	PostgresDsn string
+	// PostgresDsnEnv - настройка, из которой взят PostgresDsn, для подсказок check
+	PostgresDsnEnv string
+	Tables         ClickhouseTables
+	Labels         Labels
+}
+
+// collectorFactories - все коллекторы, в том числе выключенные в конфиге
+var collectorFactories = []CollectorFactory{&PgStatStatementsFactory{}, &PgStatioTableFactory{}, &PgTableSizeFactory{}}
+
+// CollectorSpecs - включенные в конфиге коллекторы
+func CollectorSpecs(cfg *Config) []CollectorSpec {
+	specs := []CollectorSpec{
+		{Factory: &PgStatStatementsFactory{}, Interval: cfg.Interval, PostgresDsn: cfg.PostgresDsn, PostgresDsnEnv: "POSTGRES_DSN"},
+	}
+	if cfg.StatioPostgresDsn != "" {
+		specs = append(specs,
+			CollectorSpec{Factory: &PgStatioTableFactory{}, Interval: cfg.Interval, PostgresDsn: cfg.StatioPostgresDsn, PostgresDsnEnv: "STATIO_POSTGRES_DSN"},
+			//use x4 interval because of slowly changing value
+			CollectorSpec{Factory: &PgTableSizeFactory{DiskCapacity: float64(cfg.DiskCapacity)}, Interval: cfg.Interval * 4, PostgresDsn: cfg.StatioPostgresDsn, PostgresDsnEnv: "STATIO_POSTGRES_DSN"},
+		)
+	}
+	for i := range specs {
+		specs[i].Tables = cfg.clickhouseTables(specs[i].Factory.Name())
+		specs[i].Labels = cfg.Labels
+	}
+	return specs
+}
+
+// CollectorStatus - состояние коллектора под супервизором
+type CollectorStatus struct {
+	Name        string    `json:"name"`
+	State       string    `json:"state"`
+	Restarts    int       `json:"restarts"`
+	LastTick    time.Time `json:"last_tick"`
+	LastSuccess time.Time `json:"last_success"`
+	LastError   string    `json:"last_error,omitempty"`
+	// InFlightSince - начало текущего тика, если он выполняется
+	InFlightSince *time.Time `json:"in_flight_since,omitempty"`
+	Interval      string     `json:"interval"`
+
+	interval time.Duration
+	timeout  time.Duration
+}
+
+// Supervisor запускает и останавливает коллекторы, перезапускает упавшие с backoff-ом вместо выхода из процесса
+type Supervisor struct {
+	hostname string
+
+	// reloadMu - Run и Reload меняют набор коллекторов по очереди: stopLocked отпускает mu на время остановки,
+	// и без него два reload-а запустили бы один коллектор дважды
+	reloadMu   sync.Mutex
+	mu         sync.Mutex
+	cfg        *Config
+	collectors map[string]*supervised
+	// ctx - ctx Run-а, коллекторы запускаются от него; stopping - Run останавливает коллекторы, reload уже не нужен
+	ctx      context.Context
+	stopping bool
+	wg       sync.WaitGroup
+	// fatal - ошибка, после которой демон должен остановиться
+	fatal chan error
+}
+
+type supervised struct {
+	spec     CollectorSpec
+	settings collectorSettings
+	restore  *restoredSnapshot
+	cancel   context.CancelFunc
+	done     chan struct{}
+	state    string
+	restarts int
+	lastErr  error
+	sc       *StatsCollector
+	// initSince - начало создания нового sc: NewStatsCollector сразу выполняет Init
+	initSince time.Time
+}
+
+func NewSupervisor(cfg *Config, hostname string) *Supervisor {
+	return &Supervisor{
+		hostname:   hostname,
+		cfg:        cfg,
+		collectors: make(map[string]*supervised),
+		ctx:        context.Background(),
+		fatal:      make(chan error, 1),
+	}
+}
+
+// Run запускает все коллекторы из конфига и блокируется до отмены ctx, после чего дожидается их остановки.
+// Возвращает ошибку, если коллектор с PREFLIGHT=fail не прошел проверку требований
+func (s *Supervisor) Run(ctx context.Context) error {
+	s.reloadMu.Lock()
+	s.mu.Lock()
+	s.ctx = ctx
+	for _, spec := range CollectorSpecs(s.cfg) {
+		s.start(spec, newCollectorSettings(s.cfg, spec), nil)
+	}
+	s.mu.Unlock()
+	s.reloadMu.Unlock()
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-s.fatal:
+	}
+	slog.Info("shutting down collectors")
+
+	s.reloadMu.Lock()
+	s.mu.Lock()
+	s.stopping = true
+	s.stopLocked(s.names())
+	s.mu.Unlock()
+	s.reloadMu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// Reload применяет новый конфиг: останавливает выключенные коллекторы, запускает новые и перезапускает
+// только те, у которых поменялись настройки, и выключенные preflight-ом. Если postgres тот же, перезапущенный коллектор
+// продолжает считать дельты от снапшота предыдущего, а не снимает новый baseline
+func (s *Supervisor) Reload(cfg *Config) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopping {
+		slog.Info("config reload skipped, collectors are stopping")
+		return
+	}
+
+	specs := CollectorSpecs(cfg)
+	wanted := make(map[string]bool, len(specs))
+	for _, spec := range specs {
+		wanted[spec.Factory.Name()] = true
+	}
+	var removed []string
+	for name := range s.collectors {
+		if !wanted[name] {
+			removed = append(removed, name)
+		}
+	}
+	s.stopLocked(removed)
+
+	var started, restarted, unchanged int
+	for _, spec := range specs {
+		name := spec.Factory.Name()
+		settings := newCollectorSettings(cfg, spec)
+		c, ok := s.collectors[name]
+		if !ok {
+			s.start(spec, settings, nil)
+			started++
+			continue
+		}
+		if reflect.DeepEqual(c.settings, settings) && c.state != StateDisabled {
+			unchanged++
+			continue
+		}
+		s.stopLocked([]string{name})
+		var restore *restoredSnapshot
+		if c.sc != nil && c.sc.snapshot != nil && c.settings.postgresDsn == settings.postgresDsn {
+			restore = &restoredSnapshot{snapshot: c.sc.snapshot, instance: c.sc.instance}
+		}
+		s.start(spec, settings, restore)
+		restarted++
+	}
+	s.cfg = cfg
+	slog.Info("config reloaded", "started", started, "restarted", restarted, "stopped", len(removed), "unchanged", unchanged)
+}
+
+// Status - состояние всех коллекторов, отсортированное по имени
+func (s *Supervisor) Status() []CollectorStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make([]CollectorStatus, 0, len(s.collectors))
+	for name, c := range s.collectors {
+		status := CollectorStatus{
+			Name:     name,
+			State:    c.state,
+			Restarts: c.restarts,
+			Interval: c.settings.interval.String(),
+			interval: c.settings.interval,
+			timeout:  c.settings.opts.Timeout,
+		}
+		if c.sc != nil {
+			var lastErr error
+			status.LastTick, status.LastSuccess, lastErr = c.sc.LastTick()
+			if lastErr != nil {
+				status.LastError = lastErr.Error()
+			}
+			if started := c.sc.InFlightSince(); !started.IsZero() {
+				status.InFlightSince = &started
+			}
+			if c.state == StateRunning && !c.sc.Ready() {
+				status.State = StateNotReady
+			}
+		}
+		if !c.initSince.IsZero() {
+			started := c.initSince
+			status.InFlightSince = &started
+		}
+		if status.LastError == "" && c.lastErr != nil {
+			status.LastError = c.lastErr.Error()
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// start вызывается под s.mu и s.reloadMu
+func (s *Supervisor) start(spec CollectorSpec, settings collectorSettings, restore *restoredSnapshot) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	c := &supervised{
+		spec:     spec,
+		settings: settings,
+		restore:  restore,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		state:    StateStarting,
+	}
+	s.collectors[spec.Factory.Name()] = c
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer close(c.done)
+		s.supervise(ctx, c)
+	}()
+}
+
+// stopLocked вызывается под s.mu и s.reloadMu, останавливает коллекторы параллельно и дожидается их остановки.
+// mu отпускается на время ожидания: остановка коллектора пишет его состояние под mu. Набор коллекторов
+// при этом не меняется - его меняют только Run и Reload, а они держат reloadMu
+func (s *Supervisor) stopLocked(names []string) {
+	dones := make([]chan struct{}, 0, len(names))
+	for _, name := range names {
+		c, ok := s.collectors[name]
+		if !ok {
+			continue
+		}
+		c.cancel()
+		delete(s.collectors, name)
+		dones = append(dones, c.done)
+	}
+	s.mu.Unlock()
+	for _, done := range dones {
+		<-done
+	}
+	s.mu.Lock()
+}
+
+func (s *Supervisor) names() []string {
+	names := make([]string, 0, len(s.collectors))
+	for name := range s.collectors {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (s *Supervisor) supervise(ctx context.Context, c *supervised) {
+	logger := slog.With("collector", c.spec.Factory.Name())
+	backoff := c.settings.opts.Backoff
+	backoff.Jitter = defaultBackoffJitter
+	for attempt := 0; ; attempt++ {
+		err := s.runOnce(ctx, c)
+		if ctx.Err() != nil {
+			s.setState(c, StateStopped, err)
+			logger.Info("collector stopped")
+			return
+		}
+		var preflightErr *PreflightError
+		if errors.As(err, &preflightErr) {
+			if c.settings.opts.Preflight == PreflightFail {
+				s.setState(c, StateStopped, err)
+				logger.Error("collector prerequisites are not met, stopping", "error", err)
+				select {
+				case s.fatal <- fmt.Errorf("%s: %w", c.spec.Factory.Name(), err):
+				default:
+				}
+				return
+			}
+			s.setState(c, StateDisabled, err)
+			logger.Error("collector disabled until reload", "error", err)
+			return
+		}
+		wait := backoff.Duration(attempt)
+		logger.Error("collector crashed", "restart_in", wait.Round(time.Millisecond), "error", err)
+		s.setState(c, StateRestarting, err)
+		select {
+		case <-ctx.Done():
+			s.setState(c, StateStopped, err)
+			return
+		case <-time.After(wait):
+		}
+		s.mu.Lock()
+		c.restarts++
+		s.mu.Unlock()
+	}
+}
+
+// runOnce создает коллектор и тикает его до отмены ctx. Паника коллектора возвращается как ошибка
+func (s *Supervisor) runOnce(ctx context.Context, c *supervised) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+
+	spec := c.spec
+	opts := c.settings.opts
+	// снапшот предыдущего коллектора используется только при первом запуске
+	opts.restore, c.restore = c.restore, nil
+	s.mu.Lock()
+	c.initSince = time.Now()
+	s.mu.Unlock()
+	sc, err := NewStatsCollector(
+		ctx,
+		spec.Factory,
+		s.hostname,
+		c.settings.postgresDsn,
+		c.settings.clickhouseDsn,
+		int64(c.settings.interval/time.Second)*2,
+		opts,
+	)
+	s.mu.Lock()
+	c.initSince = time.Time{}
+	s.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("unable to init collector: %w", err)
+	}
+	defer func() {
+		if shutdownErr := sc.Shutdown(); shutdownErr != nil && err == nil {
+			err = fmt.Errorf("collector shutdown failed: %w", shutdownErr)
+		}
+	}()
+
+	s.mu.Lock()
+	c.sc = sc
+	c.state = StateRunning
+	s.mu.Unlock()
+
+	if err = sc.Run(ctx, c.settings.interval); err != nil {
+		return err
+	}
+	if ctx.Err() == nil {
+		return fmt.Errorf("collector exited unexpectedly")
+	}
+	return nil
+}
+
+func (s *Supervisor) setState(c *supervised, state string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.state = state
+	if err != nil {
+		c.lastErr = err
+	}
+}
+
+// collectorSettings - все, от чего зависит работа коллектора; при reload-е коллектор перезапускается, только если они поменялись
+type collectorSettings struct {
+	interval      time.Duration
+	postgresDsn   string
+	clickhouseDsn string
+	opts          CollectorOptions
+}
+
+func newCollectorSettings(cfg *Config, spec CollectorSpec) collectorSettings {
+	return collectorSettings{
+		interval:      spec.Interval,
+		postgresDsn:   spec.PostgresDsn,
+		clickhouseDsn: cfg.ClickhouseDsn,
+		opts:          collectorOptions(cfg, spec),
+	}
+}
+
+func collectorOptions(cfg *Config, spec CollectorSpec) CollectorOptions {
+	opts := CollectorOptions{
+		Backoff: Backoff{
+			Min: cfg.BackoffMin,
+			Max: cfg.BackoffMax,
+		},
+		BreakerThreshold: cfg.BreakerThreshold,
+		Timeout:          spec.Interval,
+		StatementTimeout: cfg.StatementTimeout,
+		LockTimeout:      cfg.LockTimeout,
+		ShutdownTimeout:  cfg.ShutdownTimeout,
+		FlushOnShutdown:  cfg.ShutdownFlush,
+		DryRun:           cfg.DryRun,
+		Preflight:        cfg.Preflight,
+		AddColumns:       cfg.ClickhouseAddColumns,
+		Tables:           spec.Tables,
+		Labels:           spec.Labels,
+		PushMaxRows:      cfg.PushMaxRows,
+		PushMaxBytes:     cfg.PushMaxBytes,
+		PushRetries:      cfg.PushRetries,
+	}
+	if cfg.CollectTimeout > 0 {
+		opts.Timeout = cfg.CollectTimeout
+	}
+	// остальные коллекторы не перезапускаются при смене PLAN_SAMPLE_TOP и REGRESSION_*
+	if _, ok := spec.Factory.(*PgStatStatementsFactory); ok {
+		opts.PlanSampleTop = cfg.PlanSampleTop
+		opts.RegressionFactor = cfg.RegressionFactor
+		opts.RegressionMinCalls = cfg.RegressionMinCalls
+		opts.RegressionWebhook = cfg.RegressionWebhook
+	}
+	// настройки алертов только у коллекторов с правилами, чтобы смена правил не перезапускала остальные
+	for _, rule := range cfg.AlertRules {
+		if rule.Collector == spec.Factory.Name() {
+			opts.AlertRules = append(opts.AlertRules, rule)
+		}
+	}
+	if len(opts.AlertRules) > 0 {
+		opts.AlertCooldown = cfg.AlertCooldown
+		opts.AlertWebhook = cfg.AlertWebhook
+		opts.AlertWebhookFormat = cfg.AlertWebhookFormat
+	}
+	if cfg.SnapshotDir != "" {
+		opts.SnapshotPath = filepath.Join(cfg.SnapshotDir, spec.Factory.Name()+".json")
+	}
+	return opts
+}
@@ -0,0 +1,166 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+func getDownConfig() *Config {
+	return &Config{
+		Interval:          time.Second,
+		PostgresDsn:       postgresDownDsn,
+		ClickhouseDsn:     clickhouseDownDsn,
+		StatioPostgresDsn: postgresDownDsn,
+		BackoffMin:        10 * time.Millisecond,
+		BackoffMax:        10 * time.Millisecond,
+		ShutdownTimeout:   time.Second,
+	}
+}
+
+func getStatusNames(statuses []CollectorStatus) []string {
+	names := make([]string, 0, len(statuses))
+	for _, status := range statuses {
+		names = append(names, status.Name)
+	}
+	return names
+}
+
+func TestCollectorSpecs(t *testing.T) {
+	cfg := getDownConfig()
+
+	specs := CollectorSpecs(cfg)
+	assert.Len(t, specs, 3)
+	assert.Equal(t, 4*cfg.Interval, specs[2].Interval, "PgTableSize should use x4 interval")
+
+	cfg.StatioPostgresDsn = ""
+	specs = CollectorSpecs(cfg)
+	assert.Len(t, specs, 1)
+	assert.Equal(t, "PgStatStatements", specs[0].Factory.Name())
+}
+
+func TestCollectorOptions_AlertRules(t *testing.T) {
+	cfg := getDownConfig()
+	cfg.AlertRules, _ = parseAlertRules("PgTableSize: rate(size) > 1e9")
+	cfg.AlertWebhook = "http://alertmanager:9093/api/v2/alerts"
+
+	specs := CollectorSpecs(cfg)
+	assert.Nil(t, collectorOptions(cfg, specs[0]).AlertRules)
+	assert.Empty(t, collectorOptions(cfg, specs[0]).AlertWebhook, "webhook change doesn't restart collectors without rules")
+	assert.Equal(t, cfg.AlertRules, collectorOptions(cfg, specs[2]).AlertRules)
+	assert.Equal(t, cfg.AlertWebhook, collectorOptions(cfg, specs[2]).AlertWebhook)
+}
+
+func TestSupervisor_RunReload(t *testing.T) {
+	cfg := getDownConfig()
+	supervisor := NewSupervisor(cfg, "hostname")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		supervisor.Run(ctx)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		statuses := supervisor.Status()
+		if len(statuses) != 3 {
+			return false
+		}
+		for _, status := range statuses {
+			if status.State != StateNotReady {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond, "all collectors should be started and not ready")
+	assert.Equal(t, []string{"PgStatStatements", "PgStatioTable", "PgTableSize"}, getStatusNames(supervisor.Status()))
+
+	reloaded := getDownConfig()
+	reloaded.StatioPostgresDsn = ""
+	supervisor.Reload(reloaded)
+	assert.Equal(t, []string{"PgStatStatements"}, getStatusNames(supervisor.Status()))
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("supervisor is not stopped after ctx cancel")
+	}
+	assert.Empty(t, supervisor.Status(), "all collectors should be stopped")
+}
+
+func TestSupervisor_Reload_OnlyChanged(t *testing.T) {
+	cfg := getDownConfig()
+	supervisor := NewSupervisor(cfg, "hostname")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		supervisor.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	assert.Eventually(t, func() bool { return len(supervisor.Status()) == 3 }, 5*time.Second, 10*time.Millisecond)
+
+	supervisor.mu.Lock()
+	before := make(map[string]*supervised, len(supervisor.collectors))
+	for name, c := range supervisor.collectors {
+		before[name] = c
+	}
+	supervisor.mu.Unlock()
+
+	// меняется только dsn для pg_stat_statements
+	reloaded := getDownConfig()
+	reloaded.PostgresDsn = postgresDownDsn + "&application_name=pgstats"
+	supervisor.Reload(reloaded)
+
+	supervisor.mu.Lock()
+	defer supervisor.mu.Unlock()
+	assert.NotSame(t, before["PgStatStatements"], supervisor.collectors["PgStatStatements"], "changed collector should be restarted")
+	assert.Same(t, before["PgStatioTable"], supervisor.collectors["PgStatioTable"], "unchanged collector should keep running")
+	assert.Same(t, before["PgTableSize"], supervisor.collectors["PgTableSize"], "unchanged collector should keep running")
+}
+
+func TestSupervisor_Reload_Concurrent(t *testing.T) {
+	supervisor := NewSupervisor(getDownConfig(), "hostname")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		supervisor.Run(ctx)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool { return len(supervisor.Status()) == 3 }, 5*time.Second, 10*time.Millisecond)
+
+	// оба reload-а перезапускают PgStatStatements, запущенный первым должен быть остановлен вторым
+	var reloads sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		reloaded := getDownConfig()
+		reloaded.PostgresDsn = postgresDownDsn + fmt.Sprintf("&application_name=pgstats%d", i)
+		reloads.Add(1)
+		go func() {
+			defer reloads.Done()
+			supervisor.Reload(reloaded)
+		}()
+	}
+	reloads.Wait()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("supervisor is not stopped, a collector started by reload is left running")
+	}
+	assert.Empty(t, supervisor.Status())
+
+	supervisor.Reload(getDownConfig())
+	assert.Empty(t, supervisor.Status(), "reload after shutdown doesn't start collectors")
+}
@@ -20,3 +20,16 @@ func getHash(in ...string) uint32 {
 	}
 	return h.Sum32()
 }
+
+// insertQuery - INSERT с плейсхолдерами под каждую колонку. Непустой token уходит в SETTINGS перед VALUES:
+// драйвер отправляет все до VALUES как есть, а строки пачки дописывает после
+func insertQuery(table string, columns []string, token string) string {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	settings := ""
+	if token != "" {
+		settings = fmt.Sprintf(" SETTINGS insert_deduplication_token = '%s'", sqlEscaper.Replace(token))
+	}
+	return fmt.Sprintf("INSERT INTO %s(%s)%s VALUES (%s)", table, strings.Join(columns, ", "), settings, placeholders)
+}
+
+var sqlEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
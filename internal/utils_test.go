@@ -14,3 +14,14 @@ func TestGetHash(t *testing.T) {
 	assert.Equal(t, getHash(s1, s2, s3), getHash(s4, s5, s6), "Hash of the same strings should be equal")
 	assert.NotEqual(t, getHash(s1, s2, s3), getHash(s7, s8, s9), "Hash of diff strings should not be equal")
 }
+
+func TestInsertQuery(t *testing.T) {
+	assert.Equal(t,
+		"INSERT INTO pg.test(hostname, datname, size) VALUES (?, ?, ?)",
+		insertQuery("pg.test", []string{"hostname", "datname", "size"}, ""),
+	)
+	assert.Equal(t,
+		`INSERT INTO pg.test(hostname, size) SETTINGS insert_deduplication_token = 'PgTableSize:h\'1:3' VALUES (?, ?)`,
+		insertQuery("pg.test", []string{"hostname", "size"}, "PgTableSize:h'1:3"),
+	)
+}
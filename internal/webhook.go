@@ -0,0 +1,47 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const defaultWebhookTimeout = 10 * time.Second
+
+// webhook - POST JSON на внешний URL. Вызывается из тика, поэтому ограничен и ctx тика, и своим timeout-ом
+type webhook struct {
+	url    string
+	client *http.Client
+}
+
+func newWebhook(url string) *webhook {
+	return &webhook{url: url, client: &http.Client{Timeout: defaultWebhookTimeout}}
+}
+
+// send - payload как JSON, ответ не 2xx - ошибка с началом тела ответа
+func (w *webhook) send(ctx context.Context, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		text, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("webhook responded with %s: %s", resp.Status, bytes.TrimSpace(text))
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
@@ -0,0 +1,37 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebhook_Send(t *testing.T) {
+	var received map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	assert.NoError(t, newWebhook(server.URL).send(context.Background(), map[string]string{"event": "test"}))
+	assert.Equal(t, map[string]string{"event": "test"}, received)
+}
+
+func TestWebhook_Send_Error(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	err := newWebhook(server.URL).send(context.Background(), map[string]string{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "400 Bad Request")
+		assert.Contains(t, err.Error(), "invalid payload")
+	}
+}
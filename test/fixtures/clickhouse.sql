@@ -5,11 +5,21 @@ CREATE TABLE IF NOT EXISTS pg.pg_stat_statements (
      created_at UInt32 DEFAULT toUInt32(now()) Codec(Delta, ZSTD),
      created_hour UInt32 DEFAULT toUInt32(toStartOfHour(now())) Codec(Delta, ZSTD),
      hostname LowCardinality(String),
+     pg_role LowCardinality(String),
+     cluster LowCardinality(String),
+     environment LowCardinality(String),
+     role LowCardinality(String),
+     shard LowCardinality(String),
+     datacenter LowCardinality(String),
      datname LowCardinality(String),
      username LowCardinality(String),
      query String,
      calls Float64,
      total_time Float64,
+     min_time Float64,
+     max_time Float64,
+     mean_time Float64,
+     stddev_time Float64,
      rows Float64,
      shared_blks_hit Float64,
      shared_blks_read Float64,
@@ -36,6 +46,12 @@ CREATE TABLE IF NOT EXISTS pg.pg_statio_tables (
    created_at UInt32 DEFAULT toUInt32(now()) Codec(Delta, ZSTD),
    created_hour UInt32 DEFAULT toUInt32(toStartOfHour(now())) Codec(Delta, ZSTD),
    hostname LowCardinality(String),
+   pg_role LowCardinality(String),
+   cluster LowCardinality(String),
+   environment LowCardinality(String),
+   role LowCardinality(String),
+   shard LowCardinality(String),
+   datacenter LowCardinality(String),
    datname LowCardinality(String),
    schemaname String,
    tablename String,
@@ -72,17 +88,119 @@ CREATE TABLE IF NOT EXISTS pg.pg_table_size (
    created_at UInt32 DEFAULT toUInt32(now()) Codec(Delta, ZSTD),
    created_hour UInt32 DEFAULT toUInt32(toStartOfHour(now())) Codec(Delta, ZSTD),
    hostname LowCardinality(String),
+   pg_role LowCardinality(String),
+   cluster LowCardinality(String),
+   environment LowCardinality(String),
+   role LowCardinality(String),
+   shard LowCardinality(String),
+   datacenter LowCardinality(String),
    datname LowCardinality(String),
    schemaname String,
    tablename String,
    n_live_tup Float64,
    n_dead_tup Float64,
    size Float64,
-   idx_size Float64
+   idx_size Float64,
+   size_growth Float64,
+   idx_size_growth Float64,
+   disk_capacity Float64,
+   collected_at Float64
 ) ENGINE = MergeTree()
   PARTITION BY created_date
   ORDER BY (created_hour, hostname, created_at, datname)
   TTL created_date + toIntervalDay(12)
   SETTINGS index_granularity = 8192;
 
-CREATE TABLE IF NOT EXISTS pg.pg_table_size_buffer AS pg.pg_table_size ENGINE = Buffer(pg, pg_table_size, 16, 10, 30, 1000, 10000, 1000000, 10000000);
\ No newline at end of file
+CREATE TABLE IF NOT EXISTS pg.pg_table_size_buffer AS pg.pg_table_size ENGINE = Buffer(pg, pg_table_size, 16, 10, 30, 1000, 10000, 1000000, 10000000);
+
+CREATE TABLE IF NOT EXISTS pg.pg_instance_events (
+  created_date Date DEFAULT today(),
+  created_at UInt32 DEFAULT toUInt32(now()) Codec(Delta, ZSTD),
+  hostname LowCardinality(String),
+  collector LowCardinality(String),
+  event LowCardinality(String),
+  old_system_identifier String,
+  new_system_identifier String,
+  old_start_time UInt32,
+  new_start_time UInt32,
+  old_in_recovery UInt8,
+  new_in_recovery UInt8
+) ENGINE = MergeTree()
+  PARTITION BY toYYYYMM(created_date)
+  ORDER BY (hostname, created_at)
+  TTL created_date + toIntervalDay(90)
+  SETTINGS index_granularity = 8192;
+
+CREATE TABLE IF NOT EXISTS pg.pg_query_plans (
+  created_date Date DEFAULT today(),
+  created_at UInt32 DEFAULT toUInt32(now()) Codec(Delta, ZSTD),
+  hostname LowCardinality(String),
+  pg_role LowCardinality(String),
+  cluster LowCardinality(String),
+  environment LowCardinality(String),
+  role LowCardinality(String),
+  shard LowCardinality(String),
+  datacenter LowCardinality(String),
+  datname LowCardinality(String),
+  username LowCardinality(String),
+  queryid Int64,
+  plan_hash Int64,
+  previous_plan_hash Int64,
+  plan_changed UInt8,
+  calls Float64,
+  total_time Float64,
+  query String,
+  plan String
+) ENGINE = MergeTree()
+  PARTITION BY toYYYYMM(created_date)
+  ORDER BY (hostname, queryid, created_at)
+  TTL created_date + toIntervalDay(30)
+  SETTINGS index_granularity = 8192;
+
+CREATE TABLE IF NOT EXISTS pg.pg_query_regressions (
+  created_date Date DEFAULT today(),
+  created_at UInt32 DEFAULT toUInt32(now()) Codec(Delta, ZSTD),
+  hostname LowCardinality(String),
+  pg_role LowCardinality(String),
+  cluster LowCardinality(String),
+  environment LowCardinality(String),
+  role LowCardinality(String),
+  shard LowCardinality(String),
+  datacenter LowCardinality(String),
+  datname LowCardinality(String),
+  username LowCardinality(String),
+  queryid Int64,
+  query String,
+  reason LowCardinality(String),
+  calls Float64,
+  latency Float64,
+  baseline_latency Float64,
+  ratio Float64,
+  rows_per_call Float64,
+  baseline_rows_per_call Float64
+) ENGINE = MergeTree()
+  PARTITION BY toYYYYMM(created_date)
+  ORDER BY (hostname, created_at)
+  TTL created_date + toIntervalDay(90)
+  SETTINGS index_granularity = 8192;
+
+CREATE VIEW IF NOT EXISTS pg.pg_table_size_forecast AS
+SELECT
+  hostname,
+  datname,
+  argMax(used, collected_at) AS used_bytes,
+  argMax(capacity, collected_at) AS disk_capacity,
+  simpleLinearRegression(collected_at, used).1 * 86400 AS growth_per_day,
+  if(disk_capacity > 0 AND growth_per_day > 0, greatest(disk_capacity - used_bytes, 0) / growth_per_day, NULL) AS days_until_full
+FROM (
+  SELECT
+    hostname,
+    datname,
+    collected_at,
+    sum(size + idx_size) AS used,
+    max(disk_capacity) AS capacity
+  FROM pg.pg_table_size
+  WHERE created_date >= today() - 7 AND collected_at > 0
+  GROUP BY hostname, datname, collected_at
+)
+GROUP BY hostname, datname;
@@ -7,6 +7,10 @@ create table if not exists pg_stat_statements (
      query text,
      calls bigint,
      total_time double precision,
+     min_time double precision,
+     max_time double precision,
+     mean_time double precision,
+     stddev_time double precision,
      rows  bigint,
      shared_blks_hit bigint,
      shared_blks_read bigint,
@@ -30,6 +34,10 @@ select
     'select 1',
     1,
     2,
+    2,
+    2,
+    2,
+    0,
     3,
     4,
     5,